@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// adaptiveLimiter bounds the number of concurrent refreshFunc calls with a
+// limit adjusted by additive increase, multiplicative decrease (AIMD): every
+// call slower than the target latency halves the limit, while calls within the
+// target raise it by about one per limit's worth of calls, up to max.
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	target   time.Duration // Latency above which the backend is considered overloaded
+	max      float64       // Upper bound of the limit
+	limit    float64       // Current number of calls allowed in flight
+	inflight int           // Calls currently in flight
+	wake     chan struct{} // Closed and replaced whenever a call finishes
+}
+
+// newAdaptiveLimiter creates a limiter starting at its maximum
+func newAdaptiveLimiter(target time.Duration, max int) *adaptiveLimiter {
+	return &adaptiveLimiter{
+		target: target,
+		max:    float64(max),
+		limit:  float64(max),
+		wake:   make(chan struct{}),
+	}
+}
+
+// acquire waits for room under the limit, giving up when ctx is done
+func (l *adaptiveLimiter) acquire(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			return true
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wake:
+		}
+	}
+}
+
+// release finishes a call that took latency and adjusts the limit
+func (l *adaptiveLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	if latency > l.target {
+		l.limit = max(l.limit/2, 1)
+	} else {
+		l.limit = min(l.limit+1/l.limit, l.max)
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// state returns the calls in flight and the current limit
+func (l *adaptiveLimiter) state() (inflight, limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight, int(l.limit)
+}
+
+// RefreshConcurrency reports the refreshFunc calls in flight and the current
+// adaptive limit set up with WithAdaptiveConcurrency, or 0 without one
+func (c *Cache[K, V]) RefreshConcurrency() (inflight, limit int) {
+	if c.limiter == nil {
+		return 0, 0
+	}
+	return c.limiter.state()
+}
@@ -1,11 +1,21 @@
 package cache
 
 import (
+	"cmp"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
 	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
+	"weak"
 
 	"github.com/alphadose/haxmap"
 	"golang.org/x/exp/constraints"
@@ -19,260 +29,2706 @@ type (
 
 	// Cache holds the cache data structure and configuration
 	Cache[K hashable, V any] struct {
-		cacheMap    *haxmap.Map[K, *element[V]]                  // Map to store key-value pairs
-		RefreshTime time.Duration                                // How often to refresh cache entries
-		KeepTime    time.Duration                                // How long to keep cache entries before deleting
-		refreshFunc func(context.Context, K) (val V, store bool) // Function to generate new values
-		ctx         context.Context                              // Flag to indicate if cache is active
+		cacheMap     *haxmap.Map[K, *element[V]]           // Map to store key-value pairs
+		refreshNanos atomic.Int64                          // How often to refresh cache entries, see RefreshTime
+		keepNanos    atomic.Int64                          // How long to keep cache entries before deleting, see KeepTime
+		refreshFuncs []func(context.Context, K) (V, error) // Functions to generate new values, tried in order
+		ctx          context.Context                       // Flag to indicate if cache is active
+		cancel       context.CancelFunc
+		done         chan struct{} // Closed once the maintenance goroutine exits
+
+		depsMu sync.Mutex           // Guards deps
+		deps   map[K]map[K]struct{} // Keys derived from each key
+
+		SoftLimit   int            // Entry count past which OnSoftLimit is called, 0 to disable
+		OnSoftLimit func(size int) // Early warning callback when the cache grows past SoftLimit
+		overSoft    atomic.Bool    // Set once OnSoftLimit fired, cleared by a sweep under the limit
+
+		pool    chan func()      // Work queue of the refresh worker pool, nil when disabled
+		limiter *adaptiveLimiter // Adaptive bound on concurrent refreshes, nil when disabled
+		slots   chan struct{}    // Semaphore of WithMaxConcurrentRefresh, nil when disabled
+
+		MaxWaitersPerKey int // Gets allowed to block on a single in-flight key, 0 for no limit
+		GetManyWorkers   int // Keys GetMany resolves concurrently, 16 when unset
+
+		// MaintenanceInterval is the time between maintenance cycles, which
+		// refresh and expire entries, RefreshTime/4 when unset.  See also
+		// WithMaintenanceInterval.
+		MaintenanceInterval time.Duration
+
+		// In adaptive mode each entry is refreshed after MaxRefreshTime divided
+		// by one plus the number of Gets it served since its last refresh, but
+		// never sooner than MinRefreshTime.  Refreshes still happen on maintenance
+		// cycles, so MinRefreshTime is effectively bounded by the maintenance
+		// interval.
+		AdaptiveRefresh bool
+		MinRefreshTime  time.Duration // Refresh time of the hottest entries
+		MaxRefreshTime  time.Duration // Refresh time of unused entries, RefreshTime when unset
+
+		// RefreshJitter delays the background refresh of each entry by up to
+		// this long, so entries created in the same burst do not all refresh
+		// at once.  The delay of a key is derived from the key and
+		// RefreshJitterSeed, or a random seed chosen by the cache when unset,
+		// so it is reproducible for a given seed.
+		RefreshJitter     time.Duration
+		RefreshJitterSeed uint64
+		jitterSeed        uint64 // Fallback for RefreshJitterSeed
+
+		clock Clock // Source of time, see WithClock
+
+		lastSweep    atomic.Pointer[SweepStats] // Outcome of the latest maintenance cycle
+		sweepScanned atomic.Int64               // Entries scanned by the sweep in progress
+		sweepTotal   atomic.Int64               // Entries due when the sweep in progress began
+
+		dueMu    sync.Mutex  // Guards dueQueue
+		dueQueue dueQueue[K] // Keys by maintenance deadline, see schedule
+		rescan   atomic.Bool // Reschedule every entry on the next sweep
+
+		// OnRefreshTimeout is called when the background refresh of a key has
+		// timed out RefreshTimeoutThreshold times in a row, which means the
+		// timeout is too tight for the backend and the entry stays stale
+		OnRefreshTimeout        func(key K, consecutive int)
+		RefreshTimeoutThreshold int           // Consecutive timeouts before warning, 3 when unset
+		backgroundTimeouts      atomic.Uint64 // Background refreshes cut off by their timeout
+		backgroundCompleted     atomic.Uint64 // Background refreshes that returned in time
+
+		// MaxBytes bounds the approximate memory held by the cache, 0 for no
+		// limit.  Each maintenance cycle measures SampleSize entries (32 when
+		// unset) with SizeOf, or by walking them with reflection, to estimate
+		// the average entry size and evicts least recently used entries while
+		// the extrapolated total is above the budget.  The reflection walk
+		// ignores memory it cannot see, such as data behind unsafe pointers.
+		MaxBytes       int64
+		SampleSize     int
+		estimatedBytes atomic.Int64 // Latest estimate of the memory held
+
+		// OnEvict is called with each value leaving the cache, whether its
+		// entry expired, was evicted for size, or was removed with Delete,
+		// DeleteByTag, Clear or by invalidating a dependency, or the value was
+		// replaced by a Set, Restore or refresh, to release resources held by
+		// the value.  It is called exactly once per value, without holding any
+		// internal lock, from the goroutine removing it, including the
+		// maintenance goroutine, or once the entry holding it is borrowed, from
+		// the last release of the borrows.  A panic in OnEvict is recovered and
+		// ignored.  Entries that never held a value and those dropped by Close
+		// or GetAndDelete are not reported.
+		OnEvict func(key K, value V)
+
+		// NegativeTTL makes a key whose value failed to compute, such as one
+		// refreshFunc reports as not found, fail Gets right away for this long
+		// before being computed again, sparing the backend.  With 0 the next
+		// Get computes a failed key again.  Each failed key holds an entry for
+		// the duration, so a wide space of missing keys can hold as much
+		// memory as the cached values.
+		NegativeTTL time.Duration
+
+		// CostFunc weighs values, such as by their size in bytes, and MaxCost
+		// bounds the total weight of the cache, 0 for no limit.  Each
+		// maintenance cycle evicts least recently used entries while the total
+		// is above MaxCost.  The total is kept up to date as values are stored
+		// and removed, so CostFunc is called once per stored value.
+		CostFunc  func(V) int64
+		MaxCost   int64
+		totalCost atomic.Int64 // Sum of the costs of the cached values
+
+		// MaxEntries bounds the number of entries, 0 for no limit.  Each
+		// maintenance cycle evicts the least recently used entries past the
+		// bound, see Evict, so the cache may briefly grow above it in between.
+		MaxEntries int
+
+		// RefreshAheadWindow makes Get renew an entry in the background when
+		// it is used within this long of its KeepTime expiry, while still
+		// returning the current value right away.  0 disables it.
+		RefreshAheadWindow time.Duration
+
+		// ServeStale makes Get renew an entry in the background as soon as it
+		// is used past its refresh time, instead of waiting for a maintenance
+		// cycle, while still returning the current value right away.  At most
+		// one refresh per key is in flight.
+		ServeStale bool
+
+		// MaxStale bounds how stale a value Get may serve, 0 for no bound.
+		// Values younger than the refresh time are served as is, older ones
+		// are served while being refreshed in the background as with
+		// ServeStale, and once MaxStale old, Get refreshes them synchronously
+		// and fails if the refresh does.
+		MaxStale time.Duration
+
+		// OnStaleServe is called whenever a Get returns data older than
+		// RefreshTime, such as to set Age or Warning headers on a response
+		OnStaleServe func(key K, age time.Duration)
+
+		// OnPanic is called with the value recovered from a refresh function
+		// that panicked, such as to log it.  The panic fails that refresh with
+		// ErrPanicked, so the maintenance cycle carries on with the other keys.
+		OnPanic func(key K, recovered any)
+
+		// OnEvent is called with every Event of the cache, such as to feed
+		// tracing or logging.  It is called synchronously from the goroutine
+		// causing the event, so it must be fast, and a panic in OnEvent is
+		// recovered and ignored.
+		OnEvent func(ev Event[K])
+
+		keyLocksMu sync.Mutex     // Guards keyLocks
+		keyLocks   map[K]*keyLock // Per-key locks currently held or waited on
+
+		degraded atomic.Bool // Serve cached entries only, see SetDegraded
+
+		noStoreMu    sync.Mutex            // Guards noStoreCalls
+		noStoreCalls map[K]*refreshCall[V] // GetNoStore computations in flight
+
+		noRefresh bool // Values only change when set, see NewCounter
+
+		// ComputeOnSeparateGoroutine runs the refreshFunc call of a cold Get on
+		// its own goroutine, with the caller's context values but not its
+		// cancellation.  The caller only waits for the result, so giving up on
+		// the wait leaves the computation to complete and be cached.
+		ComputeOnSeparateGoroutine bool
+
+		// TouchOnGet records when each Get uses an entry, true by default.
+		// Turning it off keeps cache hits from writing to shared memory, which
+		// contends across cores on hot keys, at the cost of LRU eviction
+		// becoming approximate: entries rank by when they were stored rather
+		// than last read.  Hits are then left out of Stats and of the access
+		// counts behind AdaptiveRefresh and ChurnRatio.  Entries read since
+		// their last refresh are still refreshed by the maintenance cycle.
+		TouchOnGet bool
+
+		// CopyFunc, when set, is applied to every cached value Get and the
+		// other reads hand out, so that a caller mutating a slice or map value
+		// does not corrupt it for everyone else
+		CopyFunc func(V) V
+
+		// SizeOf measures values in bytes, used to weigh BytesServed and, when
+		// set, in place of the sampled estimate for MaxBytes
+		SizeOf           func(V) int
+		bytesFromCache   atomic.Uint64 // Bytes served from cached entries
+		bytesFromBackend atomic.Uint64 // Bytes served after fetching from the backend
+
+		hits             atomic.Uint64 // Gets served from an existing entry
+		misses           atomic.Uint64 // Gets that had to compute the value
+		refreshes        atomic.Uint64 // Existing entries regenerated
+		evictions        atomic.Uint64 // Entries expired or evicted for size
+		churnedEvictions atomic.Uint64 // Evictions of entries that served at most one Get
+	}
+
+	// keyLock is a per-key mutex shared by everyone serializing on the key
+	keyLock struct {
+		mu   sync.Mutex
+		refs int // Holders and waiters, guarded by keyLocksMu
+	}
+
+	// Stats reports the effectiveness of a Cache since it was created
+	Stats struct {
+		Hits             uint64  // Gets served from an existing entry without calling refreshFunc
+		Misses           uint64  // Gets that had to compute the value
+		Refreshes        uint64  // Existing entries regenerated, in the background or on demand
+		Evictions        uint64  // Entries expired or evicted for size
+		Size             int     // Entries currently in the cache, see Len
+		Degraded         bool    // Whether refreshes are stopped, see SetDegraded
+		BytesFromCache   uint64  // Bytes served from existing entries, see BytesServed
+		BytesFromBackend uint64  // Bytes served by calling refreshFunc, see BytesServed
+		ChurnRatio       float64 // Evicted entries that served at most one Get, see ChurnRatio
+	}
+
+	// SweepStats describes a single maintenance cycle of a Cache
+	SweepStats struct {
+		Start     time.Time     // When the sweep started
+		Duration  time.Duration // How long the sweep took
+		Scanned   int           // Entries due for maintenance and examined
+		Refreshed int           // Entries refreshed in the background
+		Expired   int           // Entries deleted for being past KeepTime
+		Backlog   int           // Entries already past KeepTime when the sweep started
+	}
+
+	// element struct represents a single cache entry
+	element[V any] struct {
+		data              atomic.Pointer[V]              // The cached data, see get
+		lastUsed          atomicTime                     // When the entry was last accessed
+		created           atomicTime                     // When the entry was created
+		ready             chan struct{}                  // Channel to signal when data is ready
+		abandoned         chan struct{}                  // Closed when the computing Get gives up, see abandon
+		settled           atomic.Bool                    // The computation completed or was abandoned
+		tags              map[string]string              // Metadata used for bulk operations
+		waiters           atomic.Int32                   // Number of Gets blocked on ready
+		borrows           atomic.Int32                   // Outstanding Borrow calls holding the entry
+		accesses          atomic.Uint64                  // Number of Gets served by the entry
+		accessesAtRefresh atomic.Uint64                  // Value of accesses at the last refresh
+		loaded            atomic.Bool                    // A value was stored at least once
+		refreshing        atomic.Pointer[refreshCall[V]] // Refresh of the entry in flight
+		renewing          atomic.Bool                    // A Get started a background refresh, see renew
+		cost              atomic.Int64                   // Cost of data counted in the total, -1 once removed
+		timeouts          atomic.Int32                   // Consecutive background refresh timeouts
+		source            atomic.Uint32                  // How the current data was produced, a Source
+		backend           atomic.Int32                   // Index of the refresh function that produced data
+		token             string                         // Version token of data, see NewConditional
+		err               error                          // Why the first computation failed
+		expires           atomicTime                     // Explicit expiry replacing KeepTime, see SetWithExpiry
+		stale             atomic.Bool                    // Recompute on the next Get, see Invalidate
+		used              atomic.Bool                    // Read since the last refresh, without TouchOnGet
+		static            bool                           // Never refreshed in the background nor expired, see SetStatic
+		due               atomicTime                     // Maintenance deadline, see schedule
+		evictMu           sync.Mutex                     // Guards pending against the release of borrows
+		pending           []V                            // Values left while borrowed, for OnEvict
+	}
+
+	// atomicTime is a time safe for concurrent use, zero until stored
+	atomicTime struct {
+		nanos atomic.Int64 // Unix time in nanoseconds
+	}
+
+	// refreshCall is a refresh of an existing entry, or a computation for
+	// GetNoStore, shared by every caller asking for it while it runs
+	refreshCall[V any] struct {
+		done chan struct{} // Closed when the refresh completes
+		data V             // The refreshed data
+		ok   bool          // Whether refreshFunc asked to store data
+		err  error         // Why the computation failed, for GetNoStore
+
+		shared atomic.Int32 // Callers that joined the refresh while it ran
+	}
+
+	// evictCandidate is an entry considered for least recently used eviction
+	evictCandidate[K any] struct {
+		key      K
+		lastUsed time.Time
+		accesses uint64
+		cost     int64
+	}
+
+	// CacheMap holds the cache data structure and configuration
+	CacheMap[K hashable, V any] struct {
+		cacheMap    atomic.Pointer[haxmap.Map[K, *mapElement[V]]]    // Map to store key-value pairs
+		RefreshTime time.Duration                                    // How often to refresh cache entries
+		KeepTime    time.Duration                                    // How long to keep cache entries before deleting, 0 to keep them
+		lastRefresh atomicTime                                       // Time of the last refresh
+		refreshFunc func(context.Context, func(K, V), func(K)) error // Function to generate all new values
+		ctx         context.Context                                  // Flag to indicate if cache is active
 		cancel      context.CancelFunc
+
+		ready     chan struct{} // Channel to signal when data is ready
+		markReady func()        // Closes ready once
+		done      chan struct{} // Closed once the maintenance goroutine exits
+
+		loadMu  sync.Mutex // Guards loading
+		loading *mapLoad   // Bulk refresh in flight, nil when idle
+		next    *mapLoad   // Bulk refresh to run once loading completes, see RefreshNow
+		swap    bool       // Fill a fresh map on each refresh, see WithSwapOnRefresh
+
+		// OnDuplicateKey is called when a refresh sets the same key more than
+		// once in a single pass, where the later value silently replaces the
+		// earlier one.  Setting it makes each refresh track the keys it sets.
+		OnDuplicateKey func(key K)
+		duplicateKeys  atomic.Uint64 // Duplicate keys reported so far
+
+		// OnPanic is called with the value recovered from the refresh function
+		// when it panicked, which fails that refresh with ErrPanicked and
+		// leaves the background refresh running
+		OnPanic func(recovered any)
+
+		clock   Clock                 // Source of time, see WithClock
+		lastErr atomic.Pointer[error] // Outcome of the latest refresh, nil on success
+	}
+
+	// mapLoad is a bulk refresh of a CacheMap shared by everyone asking for
+	// one while it runs
+	mapLoad struct {
+		done chan struct{} // Closed when the refresh completes
+		err  error         // Outcome of the refresh
+	}
+
+	// element struct represents a single cache entry
+	mapElement[V any] struct {
+		data      V         // The cached data
+		created   time.Time // When the entry was created
+		tombstone bool      // The key is known to be absent upstream
+	}
+
+	// Status reports the outcome of a CacheMap lookup
+	Status int
+
+	// Source tells how the current value of a Cache entry was produced
+	Source uint8
+)
+
+const (
+	SourceNone       Source = iota // No value has been stored yet
+	SourceGet                      // Computed by the Get that missed
+	SourceBackground               // Refreshed in the background
+	SourceSet                      // Stored manually with Set
+	SourceRefresh                  // Recomputed on demand, such as by Refresh or a Get of an invalidated entry
+	SourceLoad                     // Loaded from a snapshot with Restore
+)
+
+// String returns the name of the source
+func (s Source) String() string {
+	switch s {
+	case SourceGet:
+		return "get"
+	case SourceBackground:
+		return "background"
+	case SourceSet:
+		return "set"
+	case SourceRefresh:
+		return "refresh"
+	case SourceLoad:
+		return "load"
+	}
+	return "none"
+}
+
+var (
+	ErrNotStored      = errors.New("cache: refresh did not store a value")
+	ErrDegraded       = errors.New("cache: key not cached while degraded")
+	ErrTooManyWaiters = errors.New("cache: too many waiters on key")
+	ErrClosed         = errors.New("cache: closed")
+	ErrPanicked       = errors.New("cache: refresh function panicked")
+
+	// errUnchanged is returned with the cached data by a refresh that found
+	// it still current, see NewConditional
+	errUnchanged = errors.New("cache: value unchanged")
+)
+
+const (
+	StatusUnknown Status = iota // The key has never been reported by a refresh
+	StatusFound                 // The key holds a value
+	StatusAbsent                // The key was marked absent with a tombstone
+)
+
+// New creates a new cache instance with specified refresh time and refresh function
+func New[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(context.Context, K) (V, bool), opts ...Option) *Cache[K, V] {
+	return NewWithFallback(RefreshTime, KeepTime, []func(context.Context, K) (V, bool){refreshFunc}, opts...)
+}
+
+// NewWithSet creates a new cache instance like New, where the refresh
+// function also receives a set callback to store sibling keys produced by the
+// same fetch, such as from a batch endpoint.  Subsequent Gets for those
+// siblings are hits.  The value for the requested key is still the one
+// returned by refreshFunc.
+func NewWithSet[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(ctx context.Context, key K, set func(K, V)) (V, bool), opts ...Option) *Cache[K, V] {
+	var c *Cache[K, V]
+	c = New(RefreshTime, KeepTime, func(ctx context.Context, key K) (V, bool) {
+		return refreshFunc(ctx, key, func(sibling K, val V) {
+			if sibling != key {
+				c.Set(sibling, val)
+			}
+		})
+	}, opts...)
+	return c
+}
+
+// NewConditional creates a new cache instance like New for backends that
+// support conditional requests.  The refresh function receives the version
+// token, such as an ETag, of the value currently cached for the key ("" when
+// there is none) and returns the new value and token with changed set.  When
+// it reports the data unchanged, the cached value is kept and only its age is
+// reset, while an unchanged answer without a cached value stores nothing.
+func NewConditional[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(ctx context.Context, key K, prevToken string) (val V, newToken string, changed bool), opts ...Option) *Cache[K, V] {
+	var c *Cache[K, V]
+	c = newCache(RefreshTime, KeepTime, []func(context.Context, K) (V, error){func(ctx context.Context, key K) (data V, err error) {
+		value, found := c.cacheMap.Get(key)
+		var prevToken string
+		if found && value.loaded.Load() {
+			prevToken = value.token
+		}
+
+		data, token, changed := refreshFunc(ctx, key, prevToken)
+		switch {
+		case changed:
+			if found {
+				value.token = token
+			}
+			return data, nil
+		case found && value.loaded.Load():
+			return value.get(), errUnchanged
+		}
+		return data, ErrNotStored
+	}}, opts)
+	return c
+}
+
+// NewWithFallback creates a new cache instance like New with an ordered list
+// of refresh functions, such as a primary and a secondary backend.  Each value
+// is generated by trying them in sequence until one asks to store its result.
+// Backend reports which one produced the current value of an entry.
+func NewWithFallback[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFuncs []func(context.Context, K) (V, bool), opts ...Option) *Cache[K, V] {
+	funcs := make([]func(context.Context, K) (V, error), len(refreshFuncs))
+	for i, refreshFunc := range refreshFuncs {
+		funcs[i] = func(ctx context.Context, key K) (V, error) {
+			data, ok := refreshFunc(ctx, key)
+			if !ok {
+				return data, ErrNotStored
+			}
+			return data, nil
+		}
+	}
+	return newCache(RefreshTime, KeepTime, funcs, opts)
+}
+
+// NewE creates a new cache instance like New, where the refresh function
+// returns an error instead of a bool.  A non-nil error prevents storing the
+// value and is returned by GetE to every caller waiting on the computation.
+func NewE[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(context.Context, K) (V, error), opts ...Option) *Cache[K, V] {
+	return newCache(RefreshTime, KeepTime, []func(context.Context, K) (V, error){refreshFunc}, opts)
+}
+
+// newCache creates a cache instance and starts its maintenance
+func newCache[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFuncs []func(context.Context, K) (V, error), opts []Option) *Cache[K, V] {
+	o := newOptions(opts)
+
+	// Initialize new cache with provided parameters
+	c := &Cache[K, V]{
+		cacheMap:     haxmap.New[K, *element[V]](),
+		refreshFuncs: refreshFuncs,
+		done:         make(chan struct{}),
+		jitterSeed:   rand.Uint64(),
+		clock:        o.clock,
+		noRefresh:    o.noRefresh,
+
+		MaintenanceInterval: o.maintenanceInterval,
+		TouchOnGet:          true,
+	}
+	c.refreshNanos.Store(int64(RefreshTime))
+	c.keepNanos.Store(int64(KeepTime))
+	c.ctx, c.cancel = context.WithCancel(o.background)
+
+	// Stop the background goroutines of a cache dropped without Close.  They
+	// only hold it weakly while idle, so that it can be collected at all.
+	runtime.AddCleanup(c, func(cancel context.CancelFunc) { cancel() }, c.cancel)
+	ctx, clock, done, wc := c.ctx, c.clock, c.done, weak.Make(c)
+
+	if o.targetLatency > 0 && o.maxConcurrency > 0 {
+		c.limiter = newAdaptiveLimiter(o.targetLatency, o.maxConcurrency)
+	}
+	if o.maxConcurrentRefresh > 0 {
+		c.slots = make(chan struct{}, o.maxConcurrentRefresh)
+	}
+
+	// Start the refresh workers
+	if o.workers > 0 {
+		pool := make(chan func())
+		c.pool = pool
+		for range o.workers {
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case task := <-pool:
+						task()
+					}
+				}
+			}()
+		}
+	}
+
+	// Start background goroutine for cache maintenance
+	go func() {
+		defer close(done)
+
+		for ctx.Err() == nil {
+			c := wc.Value()
+			if c == nil {
+				break
+			}
+			interval := c.maintenanceInterval()
+			c = nil // Collectable while asleep
+
+			// Sleep between maintenance cycles
+			select {
+			case <-ctx.Done():
+			case <-clock.After(interval):
+			}
+
+			// Test if ctx is done
+			if ctx.Err() != nil {
+				break
+			}
+
+			if c = wc.Value(); c == nil {
+				break
+			}
+			c.sweep()
+		}
+
+		if c := wc.Value(); c != nil {
+			c.cacheMap.Clear()
+		}
+		runtime.GC()
+	}()
+	return c
+}
+
+// maintenanceInterval returns the time between maintenance cycles
+func (c *Cache[K, V]) maintenanceInterval() time.Duration {
+	if c.MaintenanceInterval > 0 {
+		return c.MaintenanceInterval
+	}
+	return c.RefreshTime() >> 2
+}
+
+// RefreshTime returns how often entries in use are refreshed
+func (c *Cache[K, V]) RefreshTime() time.Duration {
+	return time.Duration(c.refreshNanos.Load())
+}
+
+// SetRefreshTime changes how often entries in use are refreshed, taking effect
+// from the next maintenance cycle.  It is safe to call while the cache is in
+// use, such as to tune the cache to the load.
+func (c *Cache[K, V]) SetRefreshTime(d time.Duration) {
+	c.refreshNanos.Store(int64(d))
+	c.rescan.Store(true)
+}
+
+// KeepTime returns how long entries are kept before being deleted, 0 when they
+// are kept forever
+func (c *Cache[K, V]) KeepTime() time.Duration {
+	return time.Duration(c.keepNanos.Load())
+}
+
+// SetKeepTime changes how long entries are kept before being deleted, 0 to
+// keep them forever.  It is safe to call while the cache is in use.
+func (c *Cache[K, V]) SetKeepTime(d time.Duration) {
+	c.keepNanos.Store(int64(d))
+	c.rescan.Store(true)
+}
+
+// sweep runs a single maintenance cycle, refreshing entries that are still in
+// use and deleting the expired ones.  Only the entries due, as scheduled by
+// schedule, are visited.
+func (c *Cache[K, V]) sweep() {
+	stats := SweepStats{Start: c.clock.Now()}
+	if c.rescan.Swap(false) {
+		c.rescheduleAll(stats.Start)
+	}
+	due := c.popDue(stats.Start)
+	c.sweepTotal.Store(int64(len(due)))
+	defer func() {
+		c.sweepScanned.Store(0)
+		c.sweepTotal.Store(0)
+	}()
+
+	// Track keys that need to be deleted
+	var toDelete []K
+
+	// Iterate through the due cache entries
+	for _, entry := range due {
+		// Test if c.ctx is done
+		if c.ctx.Err() != nil {
+			break
+		}
+		stats.Scanned++
+		c.sweepScanned.Add(1)
+
+		key, value := entry.key, entry.value
+		sinceCreated := c.clock.Now().Sub(value.created.Load())
+
+		if value.static { // Pinned entries are left as they are
+			// No operation needed
+
+		} else if c.expired(value) { // Remove entries older than must-refresh-time
+			if c.expiredAt(value, stats.Start) { // Already expired when the sweep began
+				stats.Backlog++
+			}
+			if value.borrows.Load() == 0 { // Borrowed entries are kept until released
+				toDelete = append(toDelete, key)
+				c.countEviction(value.accesses.Load())
+			} else {
+				c.schedule(key, value, stats.Start)
+			}
+
+		} else if sinceCreated < c.refreshTime(value)+c.refreshJitter(key) { // If this is a fresh entry
+			c.schedule(key, value, c.deadline(key, value))
+
+		} else if c.noRefresh || !c.usedSinceRefresh(value) { // If entry has not been used in a while
+			// No operation needed until it expires or a Get uses it
+			// TODO: Consider staling out data early to save memory
+			c.schedule(key, value, c.expiry(value))
+
+		} else if refreshTime := c.RefreshTime(); !c.TouchOnGet || c.clock.Now().Sub(value.lastUsed.Load()) < refreshTime>>1 {
+			// Start a refresh for ensuring data is still fresh and relevant
+			withTimeout, cancel := context.WithTimeout(c.ctx, refreshTime>>1)
+			_, ok := c.refreshEntry(withTimeout, key, value, SourceBackground)
+			timedOut := !ok && withTimeout.Err() == context.DeadlineExceeded
+			cancel()
+			if timedOut {
+				c.refreshTimedOut(key, value)
+				c.schedule(key, value, stats.Start) // Retry on the next cycle
+				continue
+			}
+			c.backgroundCompleted.Add(1)
+			if !ok {
+				c.schedule(key, value, stats.Start)
+				continue
+			}
+			value.timeouts.Store(0)
+			stats.Refreshed++
+			c.schedule(key, value, c.deadline(key, value))
+
+		} else { // Used, but not lately enough to be worth a refresh
+			c.schedule(key, value, c.expiry(value))
+		}
+	}
+	// Delete all expired entries
+	c.remove(toDelete...)
+	for _, key := range toDelete {
+		c.invalidate(key)
+	}
+
+	// Keep the estimated memory use under budget
+	if c.MaxBytes > 0 {
+		c.enforceMaxBytes()
+	}
+	if c.MaxEntries > 0 {
+		c.Evict(c.MaxEntries)
+	}
+	if c.MaxCost > 0 && c.CostFunc != nil {
+		c.enforceMaxCost()
+	}
+
+	// Rearm the soft limit warning once the cache shrinks back under it
+	if int(c.cacheMap.Len()) <= c.SoftLimit {
+		c.overSoft.Store(false)
+	}
+
+	stats.Expired = len(toDelete)
+	stats.Duration = c.clock.Now().Sub(stats.Start)
+	c.lastSweep.Store(&stats)
+}
+
+// expired reports whether an entry is past its expiry
+func (c *Cache[K, V]) expired(value *element[V]) bool {
+	return c.expiredAt(value, c.clock.Now())
+}
+
+// pastExpiry reports whether an entry holds a value past the explicit expiry
+// set with SetWithExpiry
+func (c *Cache[K, V]) pastExpiry(value *element[V]) bool {
+	return value.loaded.Load() && !value.expires.Load().IsZero() && c.expired(value)
+}
+
+// usedSinceRefresh reports whether an entry served a Get since its value was
+// computed or set, as tracked by a flag rather than lastUsed without
+// TouchOnGet
+func (c *Cache[K, V]) usedSinceRefresh(value *element[V]) bool {
+	if !c.TouchOnGet {
+		return value.used.Load()
+	}
+	return !value.created.Load().After(value.lastUsed.Load())
+}
+
+// dropExpired deletes the entry for key when it holds a value past the expiry
+// set with SetWithExpiry, reporting whether it did so that the caller treats
+// the key as a miss
+func (c *Cache[K, V]) dropExpired(key K, value *element[V]) bool {
+	if !c.pastExpiry(value) {
+		return false
+	}
+	if current, ok := c.cacheMap.Get(key); ok && current == value {
+		c.remove(key)
+		c.invalidate(key)
+	}
+	return true
+}
+
+// expiredAt reports whether an entry is past its expiry at the given time,
+// either its explicit expiry or KeepTime after it was created
+func (c *Cache[K, V]) expiredAt(value *element[V], now time.Time) bool {
+	expiry := c.expiry(value)
+	return !expiry.IsZero() && now.After(expiry)
+}
+
+// expiry returns when an entry expires, either its explicit expiry or KeepTime
+// after it was created, or zero when it is kept forever
+func (c *Cache[K, V]) expiry(value *element[V]) time.Time {
+	if expires := value.expires.Load(); !expires.IsZero() {
+		return expires
+	}
+	if keepTime := c.KeepTime(); keepTime > 0 {
+		return value.created.Load().Add(keepTime)
+	}
+	return time.Time{}
+}
+
+// refreshTimedOut records a background refresh of key that was cut off by its
+// timeout and warns through OnRefreshTimeout once the key times out
+// RefreshTimeoutThreshold times in a row
+func (c *Cache[K, V]) refreshTimedOut(key K, value *element[V]) {
+	c.backgroundTimeouts.Add(1)
+	consecutive := int(value.timeouts.Add(1))
+	if c.OnRefreshTimeout != nil && consecutive == cmp.Or(c.RefreshTimeoutThreshold, 3) {
+		c.OnRefreshTimeout(key, consecutive)
+	}
+}
+
+// BackgroundRefreshTimeouts returns how many background refreshes were cut off
+// by their timeout, leaving the entry stale
+func (c *Cache[K, V]) BackgroundRefreshTimeouts() uint64 {
+	return c.backgroundTimeouts.Load()
+}
+
+// SweepProgress reports how many entries the maintenance cycle in progress has
+// scanned out of the entries due when it started.  Both are 0 between
+// cycles.  A position that stops moving points at a slow synchronous refresh.
+func (c *Cache[K, V]) SweepProgress() (scanned, total int) {
+	return int(c.sweepScanned.Load()), int(c.sweepTotal.Load())
+}
+
+// BackgroundRefreshesCompleted returns how many background refreshes returned
+// before their timeout, whether or not they stored a value.  Compared with
+// BackgroundRefreshTimeouts it shows whether the refresh timeout starves
+// legitimate backend calls.
+func (c *Cache[K, V]) BackgroundRefreshesCompleted() uint64 {
+	return c.backgroundCompleted.Load()
+}
+
+// LastSweepStats reports what the most recent maintenance cycle did.  A
+// Backlog that keeps growing between cycles means expired entries pile up
+// faster than the sweeps remove them.
+func (c *Cache[K, V]) LastSweepStats() SweepStats {
+	if stats := c.lastSweep.Load(); stats != nil {
+		return *stats
+	}
+	return SweepStats{}
+}
+
+// Close stops the background maintenance, waits for it to exit and clears the
+// cache.  Get returns immediately without a value on a closed cache.
+func (c *Cache[K, V]) Close() error {
+	c.cancel()
+	<-c.done
+	c.cacheMap.Clear()
+	return nil
+}
+
+// Get retrieves a value from the cache by key.  When ready is false, data is
+// always the zero value of V, so a zero value reported as ready was computed
+// or set as such.
+func (c *Cache[K, V]) Get(ctx context.Context, key K) (data V, ready bool) {
+	_, data, err := c.get(ctx, key)
+	return data, err == nil
+}
+
+// GetE retrieves a value from the cache by key like Get, and reports why no
+// value is available: the error of the refresh that failed to compute it,
+// ErrNotStored when a refresh function created with New declined to store
+// it, the context error, ErrDegraded, ErrTooManyWaiters or ErrClosed
+func (c *Cache[K, V]) GetE(ctx context.Context, key K) (data V, err error) {
+	_, data, err = c.get(ctx, key)
+	return
+}
+
+// GetMany retrieves the values for keys like Get, resolving up to
+// GetManyWorkers keys concurrently so that misses do not wait on each other.
+// Duplicate keys are looked up once.  Keys without a value are left out of
+// the result.  If ctx is cancelled, the values retrieved so far are returned
+// along with the context error.
+func (c *Cache[K, V]) GetMany(ctx context.Context, keys []K) (map[K]V, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[K]V, len(keys))
+		seen    = make(map[K]struct{}, len(keys))
+		sem     = make(chan struct{}, cmp.Or(c.GetManyWorkers, 16))
+	)
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if data, ok := c.Get(ctx, key); ok {
+					mu.Lock()
+					results[key] = data
+					mu.Unlock()
+				}
+			}()
+			continue
+		}
+		break
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+// Warm computes the values for keys concurrently ahead of their first Get,
+// such as a known hot set on startup.  Keys already cached are left as they
+// are.  It returns the errors of the keys that failed to compute, joined, or
+// the context error once ctx is done.
+func (c *Cache[K, V]) Warm(ctx context.Context, keys ...K) error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+		seen = make(map[K]struct{}, len(keys))
+	)
+	for _, key := range keys {
+		if _, ok := seen[key]; ok || ctx.Err() != nil {
+			continue
+		}
+		seen[key] = struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.get(ctx, key); err != nil && ctx.Err() == nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("warming %v: %w", key, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// GetWithin retrieves a value from the cache by key like Get, but only if it
+// is no older than maxAge.  An older value is refreshed synchronously, sharing
+// any refresh of the key already in flight, and if that fails no value is
+// returned.
+func (c *Cache[K, V]) GetWithin(ctx context.Context, key K, maxAge time.Duration) (data V, ready bool) {
+	value, data, err := c.get(ctx, key)
+	if err != nil || c.clock.Now().Sub(value.created.Load()) <= maxAge {
+		return data, err == nil
+	}
+	if data, ok := c.refreshEntry(ctx, key, value, SourceRefresh); ok {
+		return data, true
+	}
+	var zero V
+	return zero, false
+}
+
+// GetWithAge retrieves a value from the cache by key like Get, along with how
+// long ago it was computed.  When no value is ready, such as when ctx is done
+// while the value is being computed, age is the time since the computation
+// started.
+func (c *Cache[K, V]) GetWithAge(ctx context.Context, key K) (data V, age time.Duration, ready bool) {
+	value, data, err := c.get(ctx, key)
+	if value != nil {
+		age = c.clock.Now().Sub(value.created.Load())
+	}
+	return data, age, err == nil
+}
+
+// GetWithUpdate returns the current value for key without blocking, even if
+// it is stale.  When the value is stale or missing, it is refreshed in the
+// background and onFresh is called once with the new value, allowing callers
+// to render stale data right away and update it when fresh data arrives.
+func (c *Cache[K, V]) GetWithUpdate(ctx context.Context, key K, onFresh func(V)) (data V, ready bool) {
+	// The update outlives the call, so keep the values but not the deadline
+	bg := context.WithoutCancel(ctx)
+
+	value, ok := c.cacheMap.Get(key)
+	if !ok || value.computing() || c.dropExpired(key, value) {
+		go func() {
+			if data, ok := c.Get(bg, key); ok {
+				onFresh(data)
+			}
+		}()
+		return
+	}
+
+	data, err := c.wait(ctx, value)
+	if ready = err == nil; ready {
+		c.hit(key, value)
+	}
+	if ready && c.clock.Now().Sub(value.created.Load()) >= c.refreshTime(value) {
+		go func() {
+			if data, ok := c.refreshEntry(bg, key, value, SourceBackground); ok {
+				onFresh(data)
+			}
+		}()
+	}
+	return
+}
+
+// GetIfPresent returns the value cached for key without ever blocking or
+// calling refreshFunc, for best-effort reads.  Unlike Peek it counts as a use
+// of the entry.  Keys that are missing, still being computed, failed or were
+// invalidated are reported as not ready.
+func (c *Cache[K, V]) GetIfPresent(key K) (data V, ready bool) {
+	value, ok := c.cacheMap.Get(key)
+	if !ok || value.computing() || value.stale.Load() || c.pastExpiry(value) || c.ctx.Err() != nil {
+		return
+	}
+	if data, err := c.wait(c.ctx, value); err == nil {
+		c.hit(key, value)
+		return data, true
+	}
+	return
+}
+
+// GetOrPlaceholder returns the cached value for key without ever blocking.  On
+// a cold miss the value is computed in the background and placeholder is
+// returned with ready set to false, as it is while the computation runs.
+func (c *Cache[K, V]) GetOrPlaceholder(key K, placeholder V) (data V, ready bool) {
+	value, ok := c.cacheMap.Get(key)
+	switch {
+	case !ok || c.dropExpired(key, value):
+		go c.Get(c.ctx, key)
+	case !value.computing():
+		if data, err := c.wait(c.ctx, value); err == nil {
+			c.hit(key, value)
+			return data, true
+		}
+	}
+	return placeholder, false
+}
+
+// Borrow retrieves a value from the cache by key like Get and holds the entry
+// in the cache until release is called, so that large values can be shared
+// without copies, unless CopyFunc is set.  Expiry of a borrowed entry is
+// deferred to the first maintenance cycle after every borrow is released.
+// Release must be called exactly once; further calls are ignored.
+func (c *Cache[K, V]) Borrow(ctx context.Context, key K) (data V, release func(), ready bool) {
+	value, data, err := c.get(ctx, key)
+	if err != nil {
+		return data, func() {}, false
 	}
+	value.borrows.Add(1)
+	return data, sync.OnceFunc(func() {
+		value.evictMu.Lock()
+		var pending []V
+		if value.borrows.Add(-1) == 0 {
+			pending, value.pending = value.pending, nil
+		}
+		value.evictMu.Unlock()
+		for _, data := range pending {
+			c.evicted(key, data)
+		}
+	}), true
+}
+
+// get retrieves the entry for key, computing its value on a miss
+func (c *Cache[K, V]) get(ctx context.Context, key K) (value *element[V], data V, err error) {
+	if c.ctx.Err() != nil { // Closed
+		return nil, data, ErrClosed
+	}
+
+	// While degraded only existing entries are served, unless invalidated or
+	// past their explicit expiry
+	if c.degraded.Load() {
+		if value, ok := c.cacheMap.Get(key); ok && !value.stale.Load() && !c.pastExpiry(value) {
+			if data, err = c.wait(ctx, value); err == nil {
+				c.hit(key, value)
+			}
+			return value, data, err
+		}
+		return nil, data, ErrDegraded
+	}
+
+	// Try to get value from cache
+	value, loaded := c.cacheMap.Get(key)
+	if !loaded {
+		value, loaded = c.insert(key, func() *element[V] {
+			// If not found, create a new entry
+			elm := &element[V]{ready: make(chan struct{}, 1), abandoned: make(chan struct{})}
+			elm.created.Store(c.clock.Now())
+			return elm
+		})
+	}
+	if !loaded {
+		c.schedule(key, value, c.deadline(key, value))
+	}
+
+	// Once a failed key is past its NegativeTTL, compute it again
+	if loaded && !value.loaded.Load() && !value.expires.Load().IsZero() && !value.computing() && c.expired(value) {
+		c.dropPlaceholder(key, value)
+		return c.get(ctx, key)
+	}
+
+	// A value past the expiry set with SetWithExpiry is a miss, even before
+	// a maintenance cycle deletes it
+	if loaded && c.dropExpired(key, value) {
+		return c.get(ctx, key)
+	}
+
+	if loaded {
+		data, err = c.wait(ctx, value)
+		if canceled(err) && ctx.Err() == nil {
+			// The Get computing the value gave up, so take over
+			return c.get(ctx, key)
+		}
+		if err == nil && (value.stale.Load() || c.tooStale(value)) {
+			c.misses.Add(1)
+			c.emit(Event[K]{Kind: EventMiss, Key: key})
+			if data, ok := c.refreshEntry(ctx, key, value, SourceRefresh); ok {
+				return value, data, nil
+			}
+			var zero V
+			return value, zero, cmp.Or(ctx.Err(), ErrNotStored)
+		}
+		if err == nil {
+			c.hit(key, value)
+		}
+		return value, data, err
+	}
+
+	c.checkSoftLimit()
+	c.misses.Add(1)
+	c.emit(Event[K]{Kind: EventMiss, Key: key})
+
+	// Optionally detach the computation from the caller, who only waits for it
+	if c.ComputeOnSeparateGoroutine {
+		go c.compute(context.WithoutCancel(ctx), key, value)
+		data, err = c.wait(ctx, value)
+		return value, data, err
+	}
+
+	if data, err = c.compute(ctx, key, value); err == nil {
+		value.accesses.Add(1)
+	}
+	return value, data, err
+}
+
+// compute generates the value of a new entry and signals it is ready
+func (c *Cache[K, V]) compute(ctx context.Context, key K, value *element[V]) (data V, err error) {
+	// Signal that data is ready on close
+	defer close(value.ready)
+
+	// Hand the computation over to the waiting Gets if this one gives up
+	unlock := sync.OnceFunc(c.lockKey(key))
+	defer unlock()
+	stop := context.AfterFunc(ctx, func() {
+		c.abandon(key, value, unlock)
+	})
+	defer stop()
+
+	// Pull the data and set the data
+	data, backend, err := c.refreshLocked(ctx, key)
+	if !value.settled.CompareAndSwap(false, true) {
+		// Abandoned, so the result only goes to this caller
+		value.err = cmp.Or(err, context.Canceled)
+		return data, err
+	}
+	if err != nil {
+		value.err = err // Shared with the Gets waiting on ready
+		if c.NegativeTTL > 0 && !canceled(err) {
+			value.expires.Store(c.clock.Now().Add(c.NegativeTTL))
+			c.schedule(key, value, c.deadline(key, value))
+		} else {
+			c.dropPlaceholder(key, value) // Let the next Get try again
+		}
+		return data, err
+	}
+	c.setData(value, data)
+	value.loaded.Store(true)
+	value.lastUsed.Store(c.clock.Now())
+	value.source.Store(uint32(SourceGet))
+	value.backend.Store(int32(backend))
+	c.miss(data)
+	return c.copyOut(value.get()), nil
+}
+
+// abandon hands the computation of an entry over to the Gets waiting on it
+// when the Get computing it gives up, so they need not wait for refreshFunc to
+// return if it ignores the cancellation.  The entry is dropped and the key
+// lock released for the first of them to compute the value again with its own
+// context.  Without waiters, the computation is left to complete and be cached.
+func (c *Cache[K, V]) abandon(key K, value *element[V], unlock func()) {
+	if value.waiters.Load() == 0 || !value.settled.CompareAndSwap(false, true) {
+		return
+	}
+	c.dropPlaceholder(key, value)
+	unlock()
+	close(value.abandoned)
+}
+
+// dropPlaceholder removes the entry of a key whose value failed to compute,
+// unless it was replaced in the meantime
+func (c *Cache[K, V]) dropPlaceholder(key K, value *element[V]) {
+	if current, ok := c.cacheMap.Get(key); ok && current == value {
+		c.cacheMap.Del(key)
+	}
+}
+
+// canceled reports whether err comes from a context that was done
+func canceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// hit does the bookkeeping for data served from an existing entry
+func (c *Cache[K, V]) hit(key K, value *element[V]) {
+	if c.TouchOnGet {
+		c.hits.Add(1)
+	}
+	c.emit(Event[K]{Kind: EventHit, Key: key})
+	c.scheduleUse(key, value)
+	if c.SizeOf != nil {
+		c.bytesFromCache.Add(uint64(c.SizeOf(value.get())))
+	}
+	c.reportStale(key, value)
+	c.refreshAhead(key, value)
+	c.refreshStale(key, value)
+}
+
+// miss does the bookkeeping for data that had to be fetched to be served
+func (c *Cache[K, V]) miss(data V) {
+	if c.SizeOf != nil {
+		c.bytesFromBackend.Add(uint64(c.SizeOf(data)))
+	}
+}
+
+// BytesServed returns the total size, as measured by SizeOf, of the values
+// served from the cache and of those that had to be fetched from the backend
+func (c *Cache[K, V]) BytesServed() (fromCache, fromBackend uint64) {
+	return c.bytesFromCache.Load(), c.bytesFromBackend.Load()
+}
+
+// GetNoStore retrieves a value from the cache by key like Get, but on a miss
+// the value is computed and returned without being stored in the cache.
+// Concurrent misses for the same key share a single computation.
+func (c *Cache[K, V]) GetNoStore(ctx context.Context, key K) (data V, ready bool) {
+	if c.ctx.Err() != nil { // Closed
+		return
+	}
+	if value, ok := c.cacheMap.Get(key); ok && !c.dropExpired(key, value) {
+		data, err := c.wait(ctx, value)
+		if ready = err == nil; ready {
+			c.hit(key, value)
+		}
+		return data, ready
+	}
+	c.misses.Add(1)
+	c.emit(Event[K]{Kind: EventMiss, Key: key})
+	return c.computeNoStore(ctx, key)
+}
+
+// computeNoStore computes the value of key for GetNoStore, or joins the
+// computation in flight.  When the caller running it gives up, a waiting
+// caller still interested takes over.
+func (c *Cache[K, V]) computeNoStore(ctx context.Context, key K) (data V, ready bool) {
+	for {
+		c.noStoreMu.Lock()
+		if call, ok := c.noStoreCalls[key]; ok {
+			c.noStoreMu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-call.done:
+			}
+			if canceled(call.err) && ctx.Err() == nil {
+				continue
+			}
+			if !call.ok {
+				return
+			}
+			return c.copyOut(call.data), true
+		}
+		call := &refreshCall[V]{done: make(chan struct{})}
+		if c.noStoreCalls == nil {
+			c.noStoreCalls = make(map[K]*refreshCall[V])
+		}
+		c.noStoreCalls[key] = call
+		c.noStoreMu.Unlock()
+
+		data, _, call.err = c.refresh(ctx, key)
+		if call.err == errUnchanged {
+			call.err = nil
+		}
+		if call.ok = call.err == nil; call.ok {
+			call.data = data
+			c.miss(data)
+		}
+		c.noStoreMu.Lock()
+		delete(c.noStoreCalls, key)
+		c.noStoreMu.Unlock()
+		close(call.done)
+		return data, call.ok
+	}
+}
+
+// Len returns the number of entries in the cache, including those whose value
+// is still being computed or failed to load
+func (c *Cache[K, V]) Len() int {
+	return int(c.cacheMap.Len())
+}
+
+// LenReady returns the number of entries holding a value, which unlike Len
+// requires a scan of the cache
+func (c *Cache[K, V]) LenReady() (n int) {
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if value.loaded.Load() && !value.computing() && !c.pastExpiry(value) {
+			n++
+		}
+		return true
+	})
+	return
+}
+
+// Range calls f for each entry holding a value, in no particular order, until
+// f returns false.  Entries whose value is still being computed or is past its
+// explicit expiry are skipped.  Visiting an entry does not count as using it,
+// and f may safely Set or Delete keys while the iteration runs.
+func (c *Cache[K, V]) Range(f func(key K, value V) bool) {
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if !value.loaded.Load() || value.computing() || c.pastExpiry(value) {
+			return true
+		}
+		return f(key, c.copyOut(value.get()))
+	})
+}
+
+// TopByLastUsed returns the keys of up to n entries holding a value, most
+// recently used first.  It sorts every entry, so it suits moderate sizes such
+// as an admin page rather than hot paths.
+func (c *Cache[K, V]) TopByLastUsed(n int) []K {
+	return c.firstN(n, func(value *element[V]) time.Time { return value.lastUsed.Load() }, true)
+}
+
+// OldestN returns the keys of up to n entries holding a value, oldest first
+// by when their value was computed or set.  Like TopByLastUsed, it sorts every
+// entry.
+func (c *Cache[K, V]) OldestN(n int) []K {
+	return c.firstN(n, func(value *element[V]) time.Time { return value.created.Load() }, false)
+}
+
+// firstN returns the keys of up to n entries holding a value, sorted by stamp
+// in ascending order, or descending with latest
+func (c *Cache[K, V]) firstN(n int, stamp func(*element[V]) time.Time, latest bool) []K {
+	type stamped struct {
+		key K
+		at  time.Time
+	}
+	var entries []stamped
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if value.loaded.Load() && !value.computing() && !c.pastExpiry(value) {
+			entries = append(entries, stamped{key: key, at: stamp(value)})
+		}
+		return true
+	})
+	slices.SortFunc(entries, func(a, b stamped) int {
+		if latest {
+			return b.at.Compare(a.at)
+		}
+		return a.at.Compare(b.at)
+	})
+
+	keys := make([]K, 0, min(max(n, 0), len(entries)))
+	for _, entry := range entries[:cap(keys)] {
+		keys = append(keys, entry.key)
+	}
+	return keys
+}
+
+// OldestEntry returns the age of the oldest value in the cache, measured since
+// it was computed or set, and false when the cache holds no value.  It scans
+// every entry, so it costs as much as Range.
+func (c *Cache[K, V]) OldestEntry() (age time.Duration, ok bool) {
+	return c.entryAge(func(a, b time.Time) bool { return a.Before(b) })
+}
+
+// NewestEntry returns the age of the most recently computed or set value in
+// the cache, and false when the cache holds no value.  An age growing past
+// RefreshTime means refreshes are failing.  It scans every entry, so it costs
+// as much as Range.
+func (c *Cache[K, V]) NewestEntry() (age time.Duration, ok bool) {
+	return c.entryAge(func(a, b time.Time) bool { return a.After(b) })
+}
+
+// entryAge returns the age of the entry holding a value whose creation time
+// is preferred over all others by first
+func (c *Cache[K, V]) entryAge(first func(a, b time.Time) bool) (age time.Duration, ok bool) {
+	var found time.Time
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if !value.loaded.Load() || value.computing() || c.pastExpiry(value) {
+			return true
+		}
+		if created := value.created.Load(); !ok || first(created, found) {
+			found, ok = created, true
+		}
+		return true
+	})
+	if !ok {
+		return 0, false
+	}
+	return c.clock.Now().Sub(found), true
+}
+
+// Keys returns the keys of the entries holding a value, as visited by Range
+func (c *Cache[K, V]) Keys() (keys []K) {
+	c.Range(func(key K, _ V) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return
+}
+
+// Invalidate marks the entry for key as stale, so that the next Get
+// recomputes it synchronously instead of serving the current value.  It does
+// nothing if the key is not cached.
+func (c *Cache[K, V]) Invalidate(key K) {
+	if value, ok := c.cacheMap.Get(key); ok {
+		value.stale.Store(true)
+	}
+}
+
+// Refresh recomputes the value for key right away, replacing the cached value
+// and invalidating the keys derived from it, and returns the new value.  A
+// refresh of the key already in flight is shared.  A key that is not cached
+// yet is computed as by Get.  If the refresh fails, the cached value is kept.
+func (c *Cache[K, V]) Refresh(ctx context.Context, key K) (data V, ok bool) {
+	value, found := c.cacheMap.Get(key)
+	if !found || !value.loaded.Load() || value.computing() {
+		return c.Get(ctx, key)
+	}
+	return c.refreshEntry(ctx, key, value, SourceRefresh)
+}
+
+// Peek returns the current value for key if it holds one, without computing
+// it on a miss, waiting for a computation in flight, or counting as a use of
+// the entry, so inspecting the cache does not sway expiry or eviction
+func (c *Cache[K, V]) Peek(key K) (data V, ready bool) {
+	if value, ok := c.cacheMap.Get(key); ok && value.loaded.Load() && !value.computing() && !c.pastExpiry(value) {
+		return c.copyOut(value.get()), true
+	}
+	return
+}
+
+// Contains reports whether key holds a value, without computing or waiting
+// for it.  A key whose value is still being computed is not contained yet.
+func (c *Cache[K, V]) Contains(key K) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Clear removes every entry from the cache.  Values still being computed are
+// handled as with Delete: their waiting Gets receive the result, which is not
+// kept.  Dependencies recorded with AddDependency are kept.
+func (c *Cache[K, V]) Clear() {
+	if c.OnEvict == nil && c.OnEvent == nil && c.CostFunc == nil {
+		c.cacheMap.Clear()
+		return
+	}
+	var keys []K
+	c.cacheMap.ForEach(func(key K, _ *element[V]) bool {
+		keys = append(keys, key)
+		return true
+	})
+	c.remove(keys...)
+}
+
+// Delete removes the entry for key, along with every key derived from it.  If
+// the value is still being computed, the computation completes normally and
+// the Gets waiting on it receive its result, but it is not kept in the cache;
+// the next Get computes the value again.
+func (c *Cache[K, V]) Delete(key K) {
+	c.remove(key)
+	c.invalidate(key)
+}
+
+// GetAndDelete atomically removes the entry for key and returns its value, so
+// that it is handed out exactly once.  A miss never triggers a refresh.  An
+// entry still being computed is dropped from the cache and reported as not
+// ready, while its in-flight Gets still receive the computed value.
+func (c *Cache[K, V]) GetAndDelete(key K) (data V, ready bool) {
+	value, ok := c.cacheMap.GetAndDel(key)
+	if !ok || !c.detach(value) {
+		return
+	}
+	c.invalidate(key)
+	if value.lastUsed.Load().IsZero() || c.pastExpiry(value) {
+		return
+	}
+	return value.get(), true
+}
+
+// EverLoaded reports whether the entry for key has ever held a value, either
+// from refreshFunc or Set, and whether the key is present at all.  A present
+// key that was never loaded is still being computed, or remembered as failing
+// for NegativeTTL.
+func (c *Cache[K, V]) EverLoaded(key K) (everLoaded, present bool) {
+	if value, ok := c.cacheMap.Get(key); ok {
+		return value.loaded.Load(), true
+	}
+	return false, false
+}
+
+// Evict removes the least recently used entries until at most target entries
+// remain, regardless of their age, and returns how many were removed.
+// Borrowed and static entries and entries still being computed are never
+// evicted, so the cache may stay above target.
+func (c *Cache[K, V]) Evict(target int) int {
+	excess := int(c.cacheMap.Len()) - max(target, 0)
+	if excess <= 0 {
+		return 0
+	}
+
+	candidates := c.evictCandidates()
+	toDelete := make([]K, 0, min(excess, len(candidates)))
+	for _, candidate := range candidates[:cap(toDelete)] {
+		toDelete = append(toDelete, candidate.key)
+		c.countEviction(candidate.accesses)
+	}
+	c.remove(toDelete...)
+	for _, key := range toDelete {
+		c.invalidate(key)
+	}
+	return len(toDelete)
+}
+
+// evictCandidates returns the entries that may be evicted, least recently used
+// first
+func (c *Cache[K, V]) evictCandidates() (candidates []evictCandidate[K]) {
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if value.borrows.Load() == 0 && !value.computing() && !value.static {
+			candidates = append(candidates, evictCandidate[K]{key: key, lastUsed: value.lastUsed.Load(),
+				accesses: value.accesses.Load(), cost: max(value.cost.Load(), 0)})
+		}
+		return true
+	})
+	slices.SortFunc(candidates, func(a, b evictCandidate[K]) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+	return
+}
+
+// Partition splits the current contents of the cache into n groups, placing
+// each entry by hash(key) modulo n.  Entries still being computed, that never
+// loaded or that are past their explicit expiry are left out.
+func (c *Cache[K, V]) Partition(n int, hash func(K) int) []map[K]V {
+	if n <= 0 {
+		return nil
+	}
+	groups := make([]map[K]V, n)
+	for i := range groups {
+		groups[i] = make(map[K]V)
+	}
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if value.loaded.Load() && !value.computing() && !c.pastExpiry(value) {
+			groups[(hash(key)%n+n)%n][key] = c.copyOut(value.get())
+		}
+		return true
+	})
+	return groups
+}
+
+// Stats returns the hit, miss, refresh and eviction counts of the cache along
+// with its current size, degraded state, bytes served and churn ratio
+func (c *Cache[K, V]) Stats() Stats {
+	fromCache, fromBackend := c.BytesServed()
+	return Stats{
+		Hits:             c.hits.Load(),
+		Misses:           c.misses.Load(),
+		Refreshes:        c.refreshes.Load(),
+		Evictions:        c.evictions.Load(),
+		Size:             c.Len(),
+		Degraded:         c.Degraded(),
+		BytesFromCache:   fromCache,
+		BytesFromBackend: fromBackend,
+		ChurnRatio:       c.ChurnRatio(),
+	}
+}
+
+// countEviction records the eviction of an entry that served accesses Gets
+func (c *Cache[K, V]) countEviction(accesses uint64) {
+	c.evictions.Add(1)
+	if accesses <= 1 {
+		c.churnedEvictions.Add(1)
+	}
+}
+
+// ChurnRatio returns the fraction of evicted entries, expired or pushed out by
+// size limits, that served at most one Get.  A ratio close to 1 means keys are
+// rarely reused and the cache does little for this workload.
+func (c *Cache[K, V]) ChurnRatio() float64 {
+	evictions := c.evictions.Load()
+	if evictions == 0 {
+		return 0
+	}
+	return float64(c.churnedEvictions.Load()) / float64(evictions)
+}
+
+// get returns the data of the entry, the zero value until set
+func (e *element[V]) get() (data V) {
+	if p := e.data.Load(); p != nil {
+		data = *p
+	}
+	return
+}
+
+// set replaces the data of the entry
+func (e *element[V]) set(data V) {
+	e.data.Store(&data)
+}
+
+// Load returns the stored time, or the zero time if none was stored
+func (t *atomicTime) Load() time.Time {
+	if nanos := t.nanos.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+// Store sets the time
+func (t *atomicTime) Store(v time.Time) {
+	if v.IsZero() {
+		t.nanos.Store(0)
+		return
+	}
+	t.nanos.Store(v.UnixNano())
+}
+
+// computing reports whether the value of the entry is still being generated
+func (e *element[V]) computing() bool {
+	if e.ready == nil {
+		return false
+	}
+	select {
+	case <-e.ready:
+		return false
+	default:
+		return true
+	}
+}
+
+// Source reports how the current value for key was produced, and whether the
+// key is present
+func (c *Cache[K, V]) Source(key K) (Source, bool) {
+	if value, ok := c.cacheMap.Get(key); ok {
+		return Source(value.source.Load()), true
+	}
+	return SourceNone, false
+}
+
+// Backend reports the index of the refresh function, as passed to
+// NewWithFallback, that produced the current value for key, and whether the
+// key is present.  It is only meaningful when Source reports SourceGet,
+// SourceBackground or SourceRefresh, and always 0 for caches created with New.
+func (c *Cache[K, V]) Backend(key K) (int, bool) {
+	if value, ok := c.cacheMap.Get(key); ok {
+		return int(value.backend.Load()), true
+	}
+	return 0, false
+}
+
+// SetDegraded switches the cache in and out of degraded mode, a kill switch
+// for incidents where refreshes are known to fail.  While degraded, Gets only
+// serve entries already in the cache and fail immediately on a miss, which
+// includes invalidated entries and those past their explicit expiry, and no
+// refreshFunc calls are made, background refreshes included.
+func (c *Cache[K, V]) SetDegraded(degraded bool) {
+	c.degraded.Store(degraded)
+}
+
+// Degraded reports whether the cache is in degraded mode
+func (c *Cache[K, V]) Degraded() bool {
+	return c.degraded.Load()
+}
+
+// Waiters returns the number of Gets currently blocked waiting for the value
+// of key to be computed
+func (c *Cache[K, V]) Waiters(key K) int {
+	if value, ok := c.cacheMap.Get(key); ok {
+		return int(value.waiters.Load())
+	}
+	return 0
+}
+
+// refresh generates a new value for key, handing the work to the worker pool
+// when one is configured
+func (c *Cache[K, V]) refresh(ctx context.Context, key K) (data V, backend int, err error) {
+	defer c.lockKey(key)()
+	return c.refreshLocked(ctx, key)
+}
+
+// refreshLocked is refresh for a caller holding the key lock
+func (c *Cache[K, V]) refreshLocked(ctx context.Context, key K) (data V, backend int, err error) {
+	if c.degraded.Load() {
+		return data, 0, ErrDegraded
+	}
+
+	// Wait for a slot under the fixed concurrency limit
+	if c.slots != nil {
+		select {
+		case <-ctx.Done():
+			return data, 0, ctx.Err()
+		case <-c.ctx.Done():
+			return data, 0, ErrClosed
+		case c.slots <- struct{}{}:
+		}
+		defer func() {
+			<-c.slots
+		}()
+	}
+
+	// Wait for room under the adaptive concurrency limit
+	if c.limiter != nil {
+		if !c.limiter.acquire(ctx) {
+			return data, 0, cmp.Or(ctx.Err(), ErrClosed)
+		}
+		start := time.Now()
+		defer func() {
+			c.limiter.release(time.Since(start))
+		}()
+	}
+
+	if c.pool == nil {
+		return c.fetch(ctx, key)
+	}
+
+	done := make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return data, 0, ctx.Err()
+	case <-c.ctx.Done():
+		return data, 0, ErrClosed
+	case c.pool <- func() {
+		defer close(done)
+		data, backend, err = c.fetch(ctx, key)
+	}:
+	}
+	<-done
+	return
+}
+
+// fetch calls the refresh functions in order until one succeeds, returning
+// the index of the last one called
+func (c *Cache[K, V]) fetch(ctx context.Context, key K) (data V, backend int, err error) {
+	if c.OnEvent != nil {
+		c.emit(Event[K]{Kind: EventRefreshStart, Key: key})
+		start := time.Now()
+		defer func() {
+			ev := Event[K]{Kind: EventRefreshEnd, Key: key, Duration: time.Since(start)}
+			if err != nil && err != errUnchanged {
+				ev.Kind, ev.Err = EventError, err
+			}
+			c.emit(ev)
+		}()
+	}
+
+	err = ErrNotStored
+	for i, refreshFunc := range c.refreshFuncs {
+		backend = i
+		if data, err = c.call(ctx, key, refreshFunc); err == nil || err == errUnchanged {
+			return data, backend, err
+		}
+		if ctx.Err() != nil {
+			if !canceled(err) {
+				err = ctx.Err() // Report the cancellation rather than the failure it caused
+			}
+			break
+		}
+	}
+	var zero V // Never hand out data that was not stored
+	return zero, backend, err
+}
+
+// call runs refreshFunc for key, turning a panic into ErrPanicked reported to
+// OnPanic
+func (c *Cache[K, V]) call(ctx context.Context, key K,
+	refreshFunc func(context.Context, K) (V, error)) (data V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var zero V
+			data, err = zero, fmt.Errorf("%w: %v", ErrPanicked, r)
+			if c.OnPanic != nil {
+				defer func() {
+					recover()
+				}()
+				c.OnPanic(key, r)
+			}
+		}
+	}()
+	return refreshFunc(ctx, key)
+}
+
+// WithKeyLock runs f while holding a lock on key, serializing it against other
+// WithKeyLock calls and refreshFunc calls for the same key, save a call left
+// running by a Get that gave up on it while other Gets waited.  No value is
+// read or stored.  f must not call into the cache for the same key, as a Get
+// that needs to compute the value would wait on the lock forever.
+func (c *Cache[K, V]) WithKeyLock(key K, f func()) {
+	defer c.lockKey(key)()
+	f()
+}
+
+// lockKey acquires the per-key lock of key and returns the function releasing
+// it.  Locks only exist while held or waited on.
+func (c *Cache[K, V]) lockKey(key K) (unlock func()) {
+	c.keyLocksMu.Lock()
+	if c.keyLocks == nil {
+		c.keyLocks = make(map[K]*keyLock)
+	}
+	lock, ok := c.keyLocks[key]
+	if !ok {
+		lock = &keyLock{}
+		c.keyLocks[key] = lock
+	}
+	lock.refs++
+	c.keyLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		c.keyLocksMu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(c.keyLocks, key)
+		}
+		c.keyLocksMu.Unlock()
+	}
+}
+
+// refreshEntry regenerates the value of an existing entry.  If a refresh of
+// the same entry is already in flight, its result is shared rather than
+// calling refreshFunc a second time, whatever triggered either refresh.
+// source records what triggered the refresh that ran.
+func (c *Cache[K, V]) refreshEntry(ctx context.Context, key K, value *element[V], source Source) (data V, ok bool) {
+	call := &refreshCall[V]{done: make(chan struct{})}
+	for !value.refreshing.CompareAndSwap(nil, call) {
+		if other := value.refreshing.Load(); other != nil {
+			other.shared.Add(1)
+			select {
+			case <-ctx.Done():
+				return
+			case <-other.done:
+				if !other.ok {
+					return
+				}
+				return c.copyOut(other.data), true
+			}
+		}
+	}
+	defer func() {
+		value.refreshing.Store(nil)
+		close(call.done)
+	}()
+
+	data, backend, err := c.refresh(ctx, key)
+	unchanged := err == errUnchanged // Only the age of the cached data is reset
+	call.data, call.ok = data, err == nil || unchanged
+	if call.ok {
+		c.refreshes.Add(1)
+		if !unchanged {
+			old := value.get()
+			c.setData(value, call.data)
+			if c.OnEvict != nil && value.loaded.Load() && value.cost.Load() >= 0 {
+				c.evict(key, value, old)
+			}
+			value.source.Store(uint32(source))
+			value.backend.Store(int32(backend))
+		}
+		value.expires.Store(time.Time{})
+		value.created.Store(c.clock.Now())
+		value.stale.Store(false)
+		value.used.Store(false)
+		value.accessesAtRefresh.Store(value.accesses.Load())
+		if !unchanged {
+			c.invalidate(key)
+		}
+		return c.copyOut(call.data), true
+	}
+	return
+}
+
+// wait blocks until an existing entry is ready and returns its data, or why it
+// has none
+func (c *Cache[K, V]) wait(ctx context.Context, value *element[V]) (data V, err error) {
+	// Wait for data to be ready
+	// If ctx is cancelled or c is not ready
+	if value.ready != nil {
+		select {
+		case <-value.ready: // already populated
+		default:
+			waiters := value.waiters.Add(1)
+			defer value.waiters.Add(-1)
+			if c.MaxWaitersPerKey > 0 && int(waiters) > c.MaxWaitersPerKey {
+				return data, ErrTooManyWaiters // fail fast rather than pile up on a slow key
+			}
 
-	// element struct represents a single cache entry
-	element[V any] struct {
-		data     V             // The cached data
-		lastUsed time.Time     // When the entry was last accessed
-		created  time.Time     // When the entry was created
-		ready    chan struct{} // Channel to signal when data is ready
+			select {
+			case <-ctx.Done(): // return immediately
+				return data, ctx.Err()
+			case <-value.abandoned: // the computing Get gave up
+				return data, context.Canceled
+			case <-value.ready: // wait for the map to be populated
+			}
+		}
 	}
 
-	// CacheMap holds the cache data structure and configuration
-	CacheMap[K hashable, V any] struct {
-		cacheMap    *haxmap.Map[K, *mapElement[V]]                 // Map to store key-value pairs
-		RefreshTime time.Duration                                  // How often to refresh cache entries
-		KeepTime    time.Duration                                  // How long to keep cache entries before deleting
-		lastRefresh time.Time                                      // Time of the last refresh
-		refreshFunc func(context.Context, func(K, V)) (store bool) // Function to generate all new values
-		ctx         context.Context                                // Flag to indicate if cache is active
-		cancel      context.CancelFunc
+	if value.lastUsed.Load().IsZero() {
+		return data, cmp.Or(value.err, ErrNotStored)
+	}
+	if c.TouchOnGet {
+		value.lastUsed.Store(c.clock.Now())
+		value.accesses.Add(1)
+	} else if !value.used.Load() {
+		value.used.Store(true) // Once per refresh, keeping other reads read-only
+	}
+	return c.copyOut(value.get()), nil
+}
 
-		ready chan struct{} // Channel to signal when data is ready
+// copyOut gives a caller its own copy of a cached value, see CopyFunc
+func (c *Cache[K, V]) copyOut(data V) V {
+	if c.CopyFunc == nil {
+		return data
 	}
+	return c.CopyFunc(data)
+}
 
-	// element struct represents a single cache entry
-	mapElement[V any] struct {
-		data    V         // The cached data
-		created time.Time // When the entry was created
+// reportStale calls OnStaleServe when the data of an entry about to be served
+// is older than RefreshTime
+func (c *Cache[K, V]) reportStale(key K, value *element[V]) {
+	if c.OnStaleServe == nil {
+		return
 	}
-)
+	if age := c.clock.Now().Sub(value.created.Load()); age > c.RefreshTime() {
+		c.OnStaleServe(key, age)
+	}
+}
 
-// New creates a new cache instance with specified refresh time and refresh function
-func New[K hashable, V any](RefreshTime, KeepTime time.Duration,
-	refreshFunc func(context.Context, K) (V, bool)) *Cache[K, V] {
+// refreshAhead renews an entry in the background once it is within
+// RefreshAheadWindow of expiring, so that entries in active use never expire
+func (c *Cache[K, V]) refreshAhead(key K, value *element[V]) {
+	keepTime := c.KeepTime()
+	if c.RefreshAheadWindow <= 0 || keepTime <= 0 || value.static || value.refreshing.Load() != nil {
+		return
+	}
+	if c.clock.Now().Sub(value.created.Load()) >= keepTime-c.RefreshAheadWindow {
+		c.renew(key, value)
+	}
+}
 
-	// Initialize new cache with provided parameters
-	c := &Cache[K, V]{
-		cacheMap:    haxmap.New[K, *element[V]](),
-		RefreshTime: RefreshTime,
-		KeepTime:    KeepTime,
-		refreshFunc: refreshFunc,
+// refreshStale renews an entry in the background once it is past its refresh
+// time, see ServeStale and MaxStale
+func (c *Cache[K, V]) refreshStale(key K, value *element[V]) {
+	if (!c.ServeStale && c.MaxStale <= 0) || value.static || value.refreshing.Load() != nil {
+		return
 	}
-	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if c.clock.Now().Sub(value.created.Load()) >= c.refreshTime(value) {
+		c.renew(key, value)
+	}
+}
 
-	runtime.AddCleanup(c, func(int) {
-		c.cancel()
-		c.cacheMap.Clear()
-	}, 0)
+// tooStale reports whether an entry is past MaxStale and must be refreshed
+// before being served
+func (c *Cache[K, V]) tooStale(value *element[V]) bool {
+	return c.MaxStale > 0 && !value.static && !c.noRefresh && c.clock.Now().Sub(value.created.Load()) >= c.MaxStale
+}
 
-	// Start background goroutine for cache maintenance
+// renew refreshes an entry in the background on behalf of a Get, unless such
+// a refresh is already running
+func (c *Cache[K, V]) renew(key K, value *element[V]) {
+	if c.noRefresh || !value.renewing.CompareAndSwap(false, true) {
+		return
+	}
 	go func() {
-		for c.ctx.Err() == nil {
-			// Sleep for 1/4th of refresh time between maintenance cycles
-			time.Sleep(c.RefreshTime >> 2)
+		defer value.renewing.Store(false)
+		c.refreshEntry(c.ctx, key, value, SourceBackground)
+	}()
+}
 
-			// Test if c.ctx is done
-			if c.ctx.Err() != nil {
-				break
-			}
+// refreshTime returns how old an entry may get before it is refreshed
+func (c *Cache[K, V]) refreshTime(value *element[V]) time.Duration {
+	if !c.AdaptiveRefresh {
+		return c.RefreshTime()
+	}
+	recent := value.accesses.Load() - value.accessesAtRefresh.Load()
+	return max(cmp.Or(c.MaxRefreshTime, c.RefreshTime())/time.Duration(recent+1), c.MinRefreshTime)
+}
 
-			// Track keys that need to be deleted
-			var toDelete []K
+// refreshJitter returns how long the background refresh of key is delayed,
+// see RefreshJitter
+func (c *Cache[K, V]) refreshJitter(key K) time.Duration {
+	if c.RefreshJitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(binary.LittleEndian.AppendUint64(nil, cmp.Or(c.RefreshJitterSeed, c.jitterSeed)))
+	h.Write(fmt.Append(nil, key))
+	return time.Duration(h.Sum64() % uint64(c.RefreshJitter))
+}
 
-			// Iterate through all cache entries
-			c.cacheMap.ForEach(func(key K, value *element[V]) bool {
-				// Test if c.ctx is done
-				if c.ctx.Err() != nil {
-					return false
-				}
+// Set manually add a value to the cache for use.  Like a computed value, it
+// expires after KeepTime and, while in use, is refreshed by refreshFunc in
+// the background, see SetStatic to keep it as is.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTags(key, value, nil)
+}
+
+// SetStatic manually adds a value to the cache that is pinned: it is never
+// refreshed in the background, expired or evicted for size, and stays until
+// it is replaced or removed with Delete, DeleteByTag or Clear.  Explicit
+// calls to Refresh or Invalidate still recompute it with refreshFunc.
+func (c *Cache[K, V]) SetStatic(key K, value V) {
+	c.store(key, value, &element[V]{static: true})
+}
+
+// GetOrSet returns the value cached for key, or stores value when there is
+// none, without calling refreshFunc.  Of concurrent calls for the same key
+// only one value is stored and every caller gets it back, with loaded set by
+// those that did not store it.  A value still being computed is waited for.
+func (c *Cache[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
+	for {
+		existing, found := c.insert(key, func() *element[V] {
+			elm := &element[V]{}
+			elm.source.Store(uint32(SourceSet))
+			elm.set(value)
+			elm.loaded.Store(true)
+			now := c.clock.Now()
+			elm.created.Store(now)
+			elm.lastUsed.Store(now)
+			return elm
+		})
+		if !found {
+			c.charge(existing, value)
+			c.schedule(key, existing, c.deadline(key, existing))
+			c.invalidate(key)
+			c.checkSoftLimit()
+			return value, false
+		}
 
-				sinceCreated := time.Since(value.created)
+		if c.dropExpired(key, existing) {
+			continue
+		}
+		data, err := c.wait(c.ctx, existing)
+		if err == nil {
+			c.hit(key, existing)
+			return data, true
+		}
+		if c.ctx.Err() != nil { // Closed
+			return value, false
+		}
+		c.dropPlaceholder(key, existing) // Failed to compute, so take its place
+	}
+}
 
-				if c.KeepTime > 0 && sinceCreated > c.KeepTime { // Remove entries older than must-refresh-time
-					toDelete = append(toDelete, key)
+// insert returns the entry for key, or stores the one made by newElement when
+// there is none.  GetOrCompute may run newElement for racing callers alike and
+// keep the last, so calls are serialized by the key lock and the entry is
+// checked to be the one stored before reporting it as inserted.
+func (c *Cache[K, V]) insert(key K, newElement func() *element[V]) (value *element[V], found bool) {
+	defer c.lockKey(key)()
+	for {
+		value, found = c.cacheMap.GetOrCompute(key, newElement)
+		if current, ok := c.cacheMap.Get(key); found || !ok || current == value {
+			return
+		}
+	}
+}
 
-				} else if sinceCreated < c.RefreshTime { // If this is a fresh entry
-					// No operation needed
+// SetWithTags manually adds a value to the cache along with metadata tags,
+// which can later be used to remove entries in bulk with DeleteByTag.  The
+// tags are copied, so the caller may reuse the map.
+func (c *Cache[K, V]) SetWithTags(key K, value V, tags map[string]string) {
+	c.store(key, value, &element[V]{tags: maps.Clone(tags)})
+}
 
-				} else if value.created.After(value.lastUsed) { // If entry has not been used in a while
-					// No operation needed
-					// TODO: Consider staling out data early to save memory
+// SetWithExpiry manually adds a value to the cache that expires at expiresAt
+// instead of KeepTime after being stored, such as a token with a known expiry.
+// Past expiresAt, Get treats the entry as a miss and the maintenance cycles
+// delete it.  If the entry is refreshed before expiresAt, the new value
+// expires after KeepTime.
+func (c *Cache[K, V]) SetWithExpiry(key K, value V, expiresAt time.Time) {
+	elm := &element[V]{}
+	elm.expires.Store(expiresAt)
+	c.store(key, value, elm)
+}
 
-				} else if time.Since(value.lastUsed) < c.RefreshTime>>1 {
-					withTimeout, _ := context.WithTimeout(c.ctx, c.RefreshTime>>1)
+// store sets the data and timestamps of a manually set entry and puts it in
+// the cache
+func (c *Cache[K, V]) store(key K, data V, elm *element[V]) {
+	c.setData(elm, data)
+	elm.loaded.Store(true)
+	elm.source.Store(uint32(SourceSet))
+	now := c.clock.Now()
+	elm.created.Store(now)
+	elm.lastUsed.Store(now)
+	c.replace(key, elm)
+	c.schedule(key, elm, c.deadline(key, elm))
+	c.invalidate(key)
+	c.checkSoftLimit()
+}
 
-					// Start a refresh for ensuring data is still fresh and relevant
-					data, ok := refreshFunc(withTimeout, key)
-					if !ok {
-						return true
-					}
-					value.data, value.created = data, time.Now()
-				}
-				return true
-			})
-			// Delete all expired entries
-			c.cacheMap.Del(toDelete...)
+// replace puts elm in the cache in place of any entry for key, which leaves
+// the cache as if removed
+func (c *Cache[K, V]) replace(key K, elm *element[V]) {
+	if c.OnEvict == nil && c.OnEvent == nil && c.CostFunc == nil {
+		c.cacheMap.Set(key, elm)
+		return
+	}
+	for {
+		if old, ok := c.cacheMap.Swap(key, elm); ok {
+			c.retire(key, old)
+			return
 		}
-
-		c.cacheMap.Clear()
-		runtime.GC()
-	}()
-	return c
+		if _, loaded := c.cacheMap.GetOrSet(key, elm); !loaded {
+			return
+		}
+	}
 }
 
-// Get retrieves a value from the cache by key
-func (c *Cache[K, V]) Get(ctx context.Context, key K) (data V, ready bool) {
-	// Try to get value from cache
-	value, loaded := c.cacheMap.GetOrCompute(key, func() *element[V] {
-		// If not found, create a new entry
-		return &element[V]{
-			created: time.Now(),
-			ready:   make(chan struct{}, 1),
+// DeleteByTag removes every entry whose tag is set to val and returns the
+// number of entries removed
+func (c *Cache[K, V]) DeleteByTag(tag, val string) int {
+	var toDelete []K
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if v, ok := value.tags[tag]; ok && v == val {
+			toDelete = append(toDelete, key)
 		}
+		return true
 	})
 
-	if loaded {
-		// Wait for data to be ready
-		// If ctx is cancelled or c is not ready
-		if value.ready != nil {
-			select {
-			case <-ctx.Done(): // return immediately
-				return value.data, false
-			case <-value.ready: // wait for the map to be populated
+	c.remove(toDelete...)
+	for _, key := range toDelete {
+		c.invalidate(key)
+	}
+	return len(toDelete)
+}
+
+// checkSoftLimit calls OnSoftLimit when the cache has grown past SoftLimit.
+// The callback fires once per crossing and is rearmed by the maintenance
+// loop, so it is called at most once per maintenance cycle.
+func (c *Cache[K, V]) checkSoftLimit() {
+	if c.SoftLimit <= 0 || c.OnSoftLimit == nil {
+		return
+	}
+	if size := int(c.cacheMap.Len()); size > c.SoftLimit && c.overSoft.CompareAndSwap(false, true) {
+		c.OnSoftLimit(size)
+	}
+}
+
+// AddDependency records that dependent is derived from dependsOn, so whenever
+// dependsOn changes or leaves the cache, dependent is invalidated as well
+func (c *Cache[K, V]) AddDependency(dependent, dependsOn K) {
+	c.depsMu.Lock()
+	defer c.depsMu.Unlock()
+
+	if c.deps == nil {
+		c.deps = make(map[K]map[K]struct{})
+	}
+	dependents, ok := c.deps[dependsOn]
+	if !ok {
+		dependents = make(map[K]struct{})
+		c.deps[dependsOn] = dependents
+	}
+	dependents[dependent] = struct{}{}
+}
+
+// dependents walks the dependency graph and returns every key derived
+// directly or indirectly from key, visiting each key only once
+func (c *Cache[K, V]) dependents(key K) (found []K) {
+	c.depsMu.Lock()
+	defer c.depsMu.Unlock()
+
+	if len(c.deps) == 0 {
+		return
+	}
+	seen := map[K]struct{}{key: {}} // Cycle protection
+	queue := []K{key}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for dependent := range c.deps[next] {
+			if _, ok := seen[dependent]; ok {
+				continue
 			}
+			seen[dependent] = struct{}{}
+			found = append(found, dependent)
+			queue = append(queue, dependent)
 		}
+	}
+	return
+}
 
-		if value.lastUsed.IsZero() {
-			return value.data, false
-		}
-		value.lastUsed = time.Now()
-		return value.data, true
+// invalidate removes all entries derived from key so they are recomputed on
+// their next Get
+func (c *Cache[K, V]) invalidate(key K) {
+	if dependents := c.dependents(key); len(dependents) > 0 {
+		c.remove(dependents...)
 	}
+}
 
-	// Signal that data is ready on close
-	defer close(value.ready)
+// remove deletes the entries for keys, handing the value of each entry that
+// held one to OnEvict
+func (c *Cache[K, V]) remove(keys ...K) {
+	if c.OnEvict == nil && c.OnEvent == nil && c.CostFunc == nil {
+		c.cacheMap.Del(keys...)
+		return
+	}
+	for _, key := range keys {
+		if value, ok := c.cacheMap.GetAndDel(key); ok {
+			c.retire(key, value)
+		}
+	}
+}
 
-	// Pull the data and set the data
-	data, ok := c.refreshFunc(ctx, key)
-	if ok {
-		value.data, value.lastUsed = data, time.Now()
+// retire reports an entry taken out of the cache, unless a racing removal of
+// the same entry already did or it never held a value
+func (c *Cache[K, V]) retire(key K, value *element[V]) {
+	if !c.detach(value) || !value.loaded.Load() {
+		return
+	}
+	c.emit(Event[K]{Kind: EventEviction, Key: key})
+	if c.OnEvict != nil {
+		c.evict(key, value, value.get())
 	}
-	return value.data, ok
 }
 
-// Set manually add a value to the cache for use
-func (c *Cache[K, V]) Set(key K, value V) {
-	now := time.Now()
-	elm := &element[V]{
-		data:     value,
-		created:  now,
-		lastUsed: now,
+// evict reports data leaving the cache to OnEvict, deferred to the release of
+// the borrows of the entry holding it, if any
+func (c *Cache[K, V]) evict(key K, value *element[V], data V) {
+	if value.borrows.Load() > 0 {
+		value.evictMu.Lock()
+		if value.borrows.Load() > 0 {
+			value.pending = append(value.pending, data)
+			value.evictMu.Unlock()
+			return
+		}
+		value.evictMu.Unlock()
 	}
-	c.cacheMap.Set(key, elm)
+	c.evicted(key, data)
+}
+
+// evicted calls OnEvict, shielding the caller from a panic in the callback
+func (c *Cache[K, V]) evicted(key K, data V) {
+	defer func() {
+		recover()
+	}()
+	c.OnEvict(key, data)
 }
 
 // New creates a new cache instance with specified refresh time and refresh function
+//
+// Get blocks until the first refresh completes, including any delay requested
+// with WithInitialDelay.
 func NewMap[K hashable, V any](RefreshTime, KeepTime time.Duration,
-	refreshFunc func(context.Context, func(K, V)) bool) *CacheMap[K, V] {
+	refreshFunc func(context.Context, func(K, V)) bool, opts ...Option) *CacheMap[K, V] {
+	return NewMapWithTombstones(RefreshTime, KeepTime,
+		func(ctx context.Context, set func(K, V), _ func(K)) bool {
+			return refreshFunc(ctx, set)
+		}, opts...)
+}
+
+// NewMapWithTombstones creates a new cache instance like NewMap, where the
+// refresh function may also mark keys as known to be absent by calling
+// tombstone.  Lookup reports such keys as StatusAbsent.
+func NewMapWithTombstones[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(ctx context.Context, set func(K, V), tombstone func(K)) bool, opts ...Option) *CacheMap[K, V] {
+	return newMap(RefreshTime, KeepTime, func(ctx context.Context, set func(K, V), tombstone func(K)) error {
+		if !refreshFunc(ctx, set, tombstone) {
+			return ErrNotStored
+		}
+		return nil
+	}, opts)
+}
+
+// NewMapE creates a new cache instance like NewMap, where the refresh function
+// returns an error instead of a bool.  LastError reports the error of the
+// latest refresh, telling a map that failed to load from a missing key.
+func NewMapE[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(context.Context, func(K, V)) error, opts ...Option) *CacheMap[K, V] {
+	return newMap(RefreshTime, KeepTime, func(ctx context.Context, set func(K, V), _ func(K)) error {
+		return refreshFunc(ctx, set)
+	}, opts)
+}
+
+// newMap creates a map instance and starts its maintenance
+func newMap[K hashable, V any](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(context.Context, func(K, V), func(K)) error, opts []Option) *CacheMap[K, V] {
+	o := newOptions(opts)
+
 	// Initialize new cache with provided parameters
 	c := &CacheMap[K, V]{
-		cacheMap:    haxmap.New[K, *mapElement[V]](),
 		RefreshTime: RefreshTime,
 		KeepTime:    KeepTime,
 		refreshFunc: refreshFunc,
 		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		clock:       o.clock,
+		swap:        o.swapOnRefresh,
 	}
-	c.ctx, c.cancel = context.WithCancel(context.Background())
-	ready := sync.OnceFunc(func() {
-		close(c.ready)
+	c.cacheMap.Store(haxmap.New[K, *mapElement[V]]())
+	c.ctx, c.cancel = context.WithCancel(o.background)
+	readyCh := c.ready
+	c.markReady = sync.OnceFunc(func() {
+		close(readyCh)
 	})
+	ready := c.markReady
 
-	runtime.AddCleanup(c, func(int) {
-		c.cancel()
-		c.cacheMap.Clear()
-	}, 0)
+	// Stop the background refresh of a map dropped without Close.  It only
+	// holds the map weakly while idle, so that it can be collected at all.
+	runtime.AddCleanup(c, func(cancel context.CancelFunc) { cancel() }, c.cancel)
+	ctx, clock, done, wc := c.ctx, c.clock, c.done, weak.Make(c)
 
 	// Start background goroutine for cache maintenance
 	go func() {
+		defer close(done)
 		defer ready() // If the service is cancelled, release any holds
 
-		start := time.Now() // Mark the start of the refresh interval
-		if c.refreshFunc(c.ctx, func(key K, val V) {
-			c.cacheMap.Set(key, &mapElement[V]{
-				data:    val,
-				created: time.Now(),
-			})
-		}) && c.ctx.Err() == nil {
-			c.lastRefresh = start
-			ready()
+		// Hold off the first refresh to spread out coordinated startups
+		if wait := o.startDelay(); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-clock.After(wait):
+			}
 		}
 
-		for c.ctx.Err() == nil {
-			// Sleep for 1/4th of refresh time between maintenance cycles
-			time.Sleep(c.RefreshTime >> 2)
+		if c := wc.Value(); c != nil {
+			c.refresh(ctx)
+		}
 
-			if c.ctx.Err() != nil {
+		trigger := o.trigger
+		for ctx.Err() == nil {
+			c := wc.Value()
+			if c == nil {
 				return
 			}
+			refreshTime := c.RefreshTime
+			c = nil // Collectable while asleep
+
+			// With a trigger and no RefreshTime, only refresh when signalled
+			var tick <-chan time.Time
+			if refreshTime > 0 || trigger == nil {
+				tick = clock.After(refreshTime >> 2)
+			}
 
 			// Sleep for 1/4th of refresh time between maintenance cycles
-			time.Sleep(c.RefreshTime >> 4)
+			triggered := false
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				// Sleep for 1/4th of refresh time between maintenance cycles
+				select {
+				case <-ctx.Done():
+					return
+				case <-clock.After(refreshTime >> 4):
+				}
+			case _, ok := <-trigger:
+				if !ok { // Stop listening to a closed trigger
+					if refreshTime <= 0 { // Nothing left to refresh on
+						<-ctx.Done()
+						return
+					}
+					trigger = nil
+					continue
+				}
+				triggered = true
+			}
 
-			// Track keys that need to be deleted
-			var toDelete []K
+			if c = wc.Value(); c == nil {
+				return
+			}
+			c.sweep(triggered)
+		}
+	}()
+	return c
+}
 
-			// Iterate through all cache entries
-			c.cacheMap.ForEach(func(key K, value *mapElement[V]) bool {
-				sinceCreated := time.Since(value.created)
+// sweep runs a single maintenance cycle, deleting the entries older than
+// KeepTime and running the bulk refresh when due or triggered
+func (c *CacheMap[K, V]) sweep(triggered bool) {
+	// Track keys that need to be deleted
+	var toDelete []K
 
-				if sinceCreated > c.KeepTime { // Remove entries older than must-refresh-time
-					toDelete = append(toDelete, key)
-				}
-				return true
-			})
-			// Delete all expired entries
-			c.cacheMap.Del(toDelete...)
+	// Iterate through all cache entries
+	entries := c.cacheMap.Load()
+	entries.ForEach(func(key K, value *mapElement[V]) bool {
+		sinceCreated := c.clock.Now().Sub(value.created)
 
-			if time.Since(c.lastRefresh) < c.RefreshTime {
-				continue
+		if c.KeepTime > 0 && sinceCreated > c.KeepTime { // Remove entries older than must-refresh-time
+			toDelete = append(toDelete, key)
+		}
+		return true
+	})
+	// Delete all expired entries
+	entries.Del(toDelete...)
+
+	if !triggered && c.clock.Now().Sub(c.lastRefresh.Load()) < c.RefreshTime {
+		return
+	}
+
+	c.refresh(c.ctx)
+}
+
+// RefreshNow runs a bulk refresh right away rather than at the next tick, such
+// as when upstream signals that the whole dataset changed, and returns its
+// error.  As a refresh already in flight may have started before the change,
+// it is followed by another one, which every RefreshNow called meanwhile
+// shares.  ctx bounds the wait for a refresh started elsewhere, while a
+// refresh started by this call runs to completion.
+func (c *CacheMap[K, V]) RefreshNow(ctx context.Context) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	c.loadMu.Lock()
+	call := c.loading
+	switch {
+	case call == nil:
+		call = &mapLoad{done: make(chan struct{})}
+		c.loading = call
+		c.loadMu.Unlock()
+		c.run(call)
+		return call.err
+	case c.next == nil:
+		c.next = &mapLoad{done: make(chan struct{})}
+	}
+	call = c.next
+	c.loadMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.done:
+		return call.err
+	}
+}
+
+// refresh runs a bulk refresh, or joins the one in flight, and marks the map
+// ready once one succeeds
+func (c *CacheMap[K, V]) refresh(ctx context.Context) error {
+	c.loadMu.Lock()
+	if call := c.loading; call != nil {
+		c.loadMu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-call.done:
+			return call.err
+		}
+	}
+	call := &mapLoad{done: make(chan struct{})}
+	c.loading = call
+	c.loadMu.Unlock()
+	c.run(call)
+	return call.err
+}
+
+// run carries out the bulk refresh call, set as loading, and then starts the
+// follow-up requested by RefreshNow while it ran, if any
+func (c *CacheMap[K, V]) run(call *mapLoad) {
+	defer func() {
+		c.loadMu.Lock()
+		c.loading = nil
+		if next := c.next; next != nil {
+			c.loading, c.next = next, nil
+			go c.run(next)
+		}
+		c.loadMu.Unlock()
+		close(call.done)
+	}()
+
+	if c.ctx.Err() != nil {
+		call.err = ErrClosed
+		return
+	}
+	start := c.clock.Now() // Mark the start of the refresh interval
+	if call.err = c.load(); call.err == nil && c.ctx.Err() == nil {
+		c.lastRefresh.Store(start)
+		c.markReady()
+	}
+}
+
+// Close stops the background refresh, waits for it and any bulk refresh in
+// flight to exit and clears the map.  Get returns immediately without a value
+// on a closed map.
+func (c *CacheMap[K, V]) Close() error {
+	c.cancel()
+	<-c.done
+	for { // A completing refresh hands loading over to its follow-up
+		c.loadMu.Lock()
+		call := c.loading
+		c.loadMu.Unlock()
+		if call == nil {
+			break
+		}
+		<-call.done
+	}
+	c.cacheMap.Load().Clear()
+	return nil
+}
+
+// load runs the bulk refresh function, storing every value and tombstone it
+// reports, and records its outcome
+func (c *CacheMap[K, V]) load() (err error) {
+	// Track the keys set during this pass when duplicates are reported
+	var (
+		mu   sync.Mutex
+		seen map[K]struct{}
+	)
+	onDuplicate := c.OnDuplicateKey
+	if onDuplicate != nil {
+		seen = make(map[K]struct{})
+	}
+	// Fill a fresh map to swap in, or update the current one in place
+	target := c.cacheMap.Load()
+	if c.swap {
+		target = haxmap.New[K, *mapElement[V]]()
+	}
+	store := func(key K, elm *mapElement[V]) {
+		if seen != nil {
+			mu.Lock()
+			_, dup := seen[key]
+			seen[key] = struct{}{}
+			mu.Unlock()
+			if dup {
+				c.duplicateKeys.Add(1)
+				onDuplicate(key)
 			}
+		}
+		target.Set(key, elm)
+	}
+
+	err = c.call(func(key K, val V) {
+		store(key, &mapElement[V]{
+			data:    val,
+			created: c.clock.Now(),
+		})
+	}, func(key K) {
+		store(key, &mapElement[V]{
+			tombstone: true,
+			created:   c.clock.Now(),
+		})
+	})
+	if err != nil {
+		c.lastErr.Store(&err)
+	} else {
+		if c.swap && c.ctx.Err() == nil {
+			c.cacheMap.Store(target)
+		}
+		c.lastErr.Store(nil)
+	}
+	return
+}
 
-			start := time.Now() // Mark the start of the refresh interval
-			if c.refreshFunc(c.ctx, func(key K, val V) {
-				c.cacheMap.Set(key, &mapElement[V]{
-					data:    val,
-					created: time.Now(),
-				})
-			}) && c.ctx.Err() == nil {
-				c.lastRefresh = start
-				ready()
+// call runs the bulk refresh function, turning a panic into ErrPanicked
+// reported to OnPanic
+func (c *CacheMap[K, V]) call(set func(K, V), tombstone func(K)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrPanicked, r)
+			if c.OnPanic != nil {
+				defer func() {
+					recover()
+				}()
+				c.OnPanic(r)
 			}
 		}
 	}()
-	return c
+	return c.refreshFunc(c.ctx, set, tombstone)
+}
+
+// LastError returns the error of the latest refresh, or nil if it succeeded
+// or none completed yet.  Maps created with NewMap report a failed refresh as
+// ErrNotStored.  As Gets wait for the first successful refresh, a Get given
+// up on while LastError is set means the map failed to load.
+func (c *CacheMap[K, V]) LastError() error {
+	if err := c.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// SetMany stores every entry of entries in the map as if reported by a
+// refresh, such as an update pushed from upstream or a snapshot seeding the
+// map.  Seeding before the first refresh completes unblocks the waiting Gets.
+func (c *CacheMap[K, V]) SetMany(entries map[K]V) {
+	now := c.clock.Now()
+	for key, val := range entries {
+		c.cacheMap.Load().Set(key, &mapElement[V]{
+			data:    val,
+			created: now,
+		})
+	}
+	c.markReady()
+}
+
+// LastRefresh returns when the latest successful refresh of the map started,
+// or the zero time if none succeeded yet
+func (c *CacheMap[K, V]) LastRefresh() time.Time {
+	return c.lastRefresh.Load()
+}
+
+// Stale reports whether the map is overdue for a refresh, having gone more
+// than RefreshTime without a successful one, such as while refreshFunc keeps
+// failing.  A map that never loaded is stale.
+func (c *CacheMap[K, V]) Stale() bool {
+	last := c.lastRefresh.Load()
+	if last.IsZero() {
+		return true
+	}
+	return c.RefreshTime > 0 && c.clock.Now().Sub(last) > c.RefreshTime
+}
+
+// DuplicateKeys returns how many times a refresh reported a key it had already
+// set during the same pass, counted while OnDuplicateKey is set
+func (c *CacheMap[K, V]) DuplicateKeys() uint64 {
+	return c.duplicateKeys.Load()
 }
 
 // Get retrieves a value from the cache by key
 func (c *CacheMap[K, V]) Get(ctx context.Context, key K) (data V, found bool) {
+	data, status := c.Lookup(ctx, key)
+	return data, status == StatusFound
+}
+
+// Lookup retrieves a value from the cache by key, reporting whether the key
+// was found, is known to be absent, or is unknown
+func (c *CacheMap[K, V]) Lookup(ctx context.Context, key K) (data V, status Status) {
+	if !c.WaitReady(ctx) {
+		return
+	}
+
+	// Try to get value from cache
+	value, loaded := c.cacheMap.Load().Get(key)
+	switch {
+	case !loaded:
+		return data, StatusUnknown
+	case value.tombstone:
+		return data, StatusAbsent
+	}
+	return value.data, StatusFound
+}
+
+// GetMany retrieves the values for keys like Get, waiting for the map to be
+// populated only once.  Keys without a value are left out of the result, and
+// ready is false, with no values, if ctx is done before the map is populated.
+func (c *CacheMap[K, V]) GetMany(ctx context.Context, keys ...K) (values map[K]V, ready bool) {
+	if !c.WaitReady(ctx) {
+		return nil, false
+	}
+	values = make(map[K]V, len(keys))
+	entries := c.cacheMap.Load() // All from the same refresh, see WithSwapOnRefresh
+	for _, key := range keys {
+		if value, ok := entries.Get(key); ok && !value.tombstone {
+			values[key] = value.data
+		}
+	}
+	return values, true
+}
+
+// Snapshot waits for the map to be populated and returns a copy of every key
+// holding a value, or nil if ctx is done first.  Values are copied as is, so
+// pointers, slices and maps in V are shared with the map, see SnapshotFunc.
+// Values stored by a refresh running during the copy may or may not be
+// included.
+func (c *CacheMap[K, V]) Snapshot(ctx context.Context) map[K]V {
+	return c.SnapshotFunc(ctx, nil)
+}
+
+// SnapshotFunc returns a copy of the map like Snapshot, with each value
+// passed through clone, such as to deep copy values holding references so the
+// snapshot can be modified safely.  A nil clone copies values as is.
+func (c *CacheMap[K, V]) SnapshotFunc(ctx context.Context, clone func(V) V) map[K]V {
+	if !c.WaitReady(ctx) {
+		return nil
+	}
+	snapshot := make(map[K]V, c.cacheMap.Load().Len())
+	c.Range(func(key K, value V) bool {
+		if clone != nil {
+			value = clone(value)
+		}
+		snapshot[key] = value
+		return true
+	})
+	return snapshot
+}
+
+// WaitReady blocks until the first refresh populates the map, such as for a
+// startup barrier, reporting false if ctx is done first or the map is closed
+func (c *CacheMap[K, V]) WaitReady(ctx context.Context) bool {
+	if c.ctx.Err() != nil { // Closed
+		return false
+	}
+
 	// If ctx is cancelled or c is not ready
 	select {
 	case <-ctx.Done(): // return immediately
-		return
+		return false
 	case <-c.ready: // wait for the map to be populated
+		return true
 	}
+}
 
-	// Try to get value from cache
-	value, loaded := c.cacheMap.Get(key)
-	if loaded {
-		return value.data, true
+// Len returns the number of entries in the map, tombstones included
+func (c *CacheMap[K, V]) Len() int {
+	return int(c.cacheMap.Load().Len())
+}
+
+// Delete removes keys from the map.  Deletes are transient: a key still
+// reported upstream comes back with the next successful refresh.
+func (c *CacheMap[K, V]) Delete(keys ...K) {
+	c.cacheMap.Load().Del(keys...)
+}
+
+// Range calls f for each key holding a value, in no particular order, until f
+// returns false.  Tombstoned keys are skipped.
+func (c *CacheMap[K, V]) Range(f func(key K, value V) bool) {
+	c.cacheMap.Load().ForEach(func(key K, value *mapElement[V]) bool {
+		if value.tombstone {
+			return true
+		}
+		return f(key, value.data)
+	})
+}
+
+// Clear removes every entry from the map, after which lookups report
+// StatusUnknown until the next refresh repopulates it.  Clearing while a
+// refresh is running is safe, but the values that refresh stores after the
+// Clear are kept, leaving the map partially populated until the next pass.
+func (c *CacheMap[K, V]) Clear() {
+	c.cacheMap.Load().Clear()
+}
+
+// ToCache creates a lazy Cache with the same RefreshTime and KeepTime, seeded
+// with the current entries of the map and maintained per key by refreshFunc
+// from then on.  Tombstoned keys are not carried over.
+func (c *CacheMap[K, V]) ToCache(refreshFunc func(context.Context, K) (V, bool), opts ...Option) *Cache[K, V] {
+	lazy := New(c.RefreshTime, c.KeepTime, refreshFunc, opts...)
+	c.cacheMap.Load().ForEach(func(key K, value *mapElement[V]) bool {
+		if !value.tombstone {
+			lazy.Set(key, value.data)
+		}
+		return true
+	})
+	return lazy
+}
+
+// Diff compares a previously captured snapshot against the current contents
+// of the map and reports which keys were added, removed, or changed, using
+// equal to compare values
+func (c *CacheMap[K, V]) Diff(prev map[K]V, equal func(a, b V) bool) (added, removed, changed []K) {
+	seen := make(map[K]struct{}, len(prev))
+	c.cacheMap.Load().ForEach(func(key K, value *mapElement[V]) bool {
+		if value.tombstone {
+			return true
+		}
+		old, ok := prev[key]
+		if !ok {
+			added = append(added, key)
+			return true
+		}
+		seen[key] = struct{}{}
+		if !equal(old, value.data) {
+			changed = append(changed, key)
+		}
+		return true
+	})
+
+	for key := range prev {
+		if _, ok := seen[key]; !ok {
+			removed = append(removed, key)
+		}
 	}
 	return
 }
@@ -1,9 +1,15 @@
 package cache_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -62,3 +68,3239 @@ func TestCacheMap(t *testing.T) {
 	one, ok = cache.Get(ctx, "3")
 	log.Println("3:", one, ok)
 }
+
+func TestCacheDependency(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	c.AddDependency("b", "a")
+	c.AddDependency("c", "b")
+	c.AddDependency("a", "c") // Cycles must not loop forever
+
+	ctx := context.Background()
+	c.Set("b", 10)
+	c.Set("c", 20)
+	c.Set("a", 1)
+
+	if v, ok := c.Get(ctx, "b"); !ok || v != 1 {
+		t.Fatal("expected b to be recomputed, got", v, ok)
+	}
+	if v, ok := c.Get(ctx, "c"); !ok || v != 1 {
+		t.Fatal("expected c to be recomputed, got", v, ok)
+	}
+}
+
+func TestCacheDeleteByTag(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return 0, false
+	})
+	tags := map[string]string{"region": "east"}
+	c.SetWithTags("a", 1, tags)
+	c.SetWithTags("b", 2, map[string]string{"region": "west"})
+	c.SetWithTags("c", 3, map[string]string{"region": "east"})
+	c.Set("d", 4)
+	tags["region"] = "west" // Reusing the map leaves the stored tags alone
+
+	if n := c.DeleteByTag("region", "east"); n != 2 {
+		t.Fatal("expected 2 entries removed, got", n)
+	}
+	ctx := context.Background()
+	if _, ok := c.Get(ctx, "a"); ok {
+		t.Fatal("expected a to be removed")
+	}
+	if v, ok := c.Get(ctx, "b"); !ok || v != 2 {
+		t.Fatal("expected b to remain, got", v, ok)
+	}
+}
+
+func TestCacheMaxWaiters(t *testing.T) {
+	release := make(chan struct{})
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		<-release
+		return len(s), true
+	})
+	c.MaxWaitersPerKey = 1
+
+	ctx := context.Background()
+	go c.Get(ctx, "slow") // The computing caller
+	for c.Waiters("slow") == 0 {
+		go c.Get(ctx, "slow") // A waiter
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := c.Get(ctx, "slow"); ok {
+		t.Fatal("expected excess waiter to fail fast")
+	}
+	close(release)
+	for c.Waiters("slow") > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, ok := c.Get(ctx, "slow"); !ok || v != 4 {
+		t.Fatal("expected value once computed, got", v, ok)
+	}
+}
+
+func TestCacheMapStale(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var loads atomic.Int32
+	c := cache.NewMap[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		set("key", 1)
+		return loads.Add(1) == 1 // Only the first refresh succeeds
+	}, cache.WithClock(clock))
+	defer c.Close()
+
+	c.Get(context.Background(), "key")
+	if c.Stale() || !c.LastRefresh().Equal(clock.Now()) {
+		t.Fatal("expected a fresh map, last refreshed", c.LastRefresh())
+	}
+	clock.Advance(2 * time.Hour)
+	if !c.Stale() {
+		t.Fatal("expected the map to be stale")
+	}
+}
+
+func TestCacheMapDelete(t *testing.T) {
+	trigger := make(chan struct{})
+	var loads atomic.Int32
+	c := cache.NewMap[string, int](0, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		set("a", 1)
+		set("b", 2)
+		loads.Add(1)
+		return true
+	}, cache.WithRefreshTrigger(trigger))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	c.Delete("a")
+	if _, ok := c.Get(ctx, "a"); ok {
+		t.Fatal("expected the key to be deleted")
+	}
+	seen := 0
+	c.Range(func(string, int) bool {
+		seen++
+		return true
+	})
+	if seen != 1 {
+		t.Fatal("expected a single remaining key, got", seen)
+	}
+
+	trigger <- struct{}{}
+	for deadline := time.Now().Add(time.Second); loads.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("refresh was not triggered")
+		}
+	}
+	if v, ok := c.Get(ctx, "a"); !ok || v != 1 {
+		t.Fatal("expected the key back after a refresh, got", v, ok)
+	}
+}
+
+func TestCacheMapLastError(t *testing.T) {
+	errUpstream := errors.New("upstream down")
+	c := cache.NewMapE[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) error {
+		return errUpstream
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := c.Get(ctx, "key"); ok {
+		t.Fatal("expected no value from a map that failed to load")
+	}
+	if err := c.LastError(); !errors.Is(err, errUpstream) {
+		t.Fatal("expected the refresh error, got", err)
+	}
+}
+
+func TestCacheMapKeepForever(t *testing.T) {
+	var loads atomic.Int32
+	c := cache.NewMap[string, int](20*time.Millisecond, 0, func(ctx context.Context, set func(string, int)) bool {
+		if loads.Add(1) == 1 {
+			set("key", 1) // Only reported by the first refresh
+		}
+		return true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	for deadline := time.Now().Add(time.Second); loads.Load() < 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected several refresh cycles")
+		}
+	}
+	if v, ok := c.Get(ctx, "key"); !ok || v != 1 {
+		t.Fatal("expected a zero KeepTime to keep entries, got", v, ok)
+	}
+}
+
+func TestCacheMapSetMany(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		<-release
+		return true
+	})
+
+	c.SetMany(map[string]int{"a": 1, "b": 2})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if v, ok := c.Get(ctx, "b"); !ok || v != 2 {
+		t.Fatal("expected the seeded value before the first refresh, got", v, ok)
+	}
+}
+
+func TestCacheMapWaitReady(t *testing.T) {
+	release := make(chan struct{})
+	c := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		<-release
+		set("a", 1)
+		return true
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if c.WaitReady(ctx) {
+		t.Fatal("expected the map not to be ready before the first refresh")
+	}
+	close(release)
+	if !c.WaitReady(context.Background()) {
+		t.Fatal("expected the map to be ready after the first refresh")
+	}
+}
+
+func TestCacheMapRefreshPanic(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		if calls.Add(1) == 1 {
+			panic("boom")
+		}
+		set("a", 1)
+		return true
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for c.RefreshNow(ctx) != nil && ctx.Err() == nil {
+	}
+	if v, ok := c.Get(ctx, "a"); !ok || v != 1 {
+		t.Fatal("expected the map to recover from the panic, got", v, ok)
+	}
+}
+
+func TestCacheMapGetMany(t *testing.T) {
+	c := cache.NewMapWithTombstones[string, int](time.Hour, time.Hour,
+		func(ctx context.Context, set func(string, int), tombstone func(string)) bool {
+			set("a", 1)
+			set("b", 2)
+			tombstone("gone")
+			return true
+		})
+	defer c.Close()
+
+	values, ready := c.GetMany(context.Background(), "a", "b", "gone", "missing")
+	if !ready || len(values) != 2 || values["a"] != 1 || values["b"] != 2 {
+		t.Fatal("expected the found subset, got", values, ready)
+	}
+}
+
+func TestCacheMapSnapshot(t *testing.T) {
+	c := cache.NewMapWithTombstones[string, []int](time.Hour, time.Hour,
+		func(ctx context.Context, set func(string, []int), tombstone func(string)) bool {
+			set("a", []int{1})
+			tombstone("gone")
+			return true
+		})
+	defer c.Close()
+
+	ctx := context.Background()
+	if snapshot := c.Snapshot(ctx); len(snapshot) != 1 || snapshot["a"][0] != 1 {
+		t.Fatal("expected the values without tombstones, got", snapshot)
+	}
+	snapshot := c.SnapshotFunc(ctx, func(v []int) []int {
+		return append([]int(nil), v...)
+	})
+	snapshot["a"][0] = 2
+	if v, _ := c.Get(ctx, "a"); v[0] != 1 {
+		t.Fatal("expected the copied values to be independent of the map, got", v)
+	}
+}
+
+func TestCacheMapRefreshNow(t *testing.T) {
+	var calls atomic.Int32
+	gate := make(chan struct{})
+	c := cache.NewMap[string, int32](time.Hour, time.Hour, func(ctx context.Context, set func(string, int32)) bool {
+		n := calls.Add(1)
+		if n == 2 {
+			<-gate
+		}
+		set("version", n)
+		return true
+	})
+	defer c.Close()
+	ctx := context.Background()
+	c.Get(ctx, "version")
+	first := c.LastRefresh()
+
+	// A refresh in flight when the others are called
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := c.RefreshNow(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	for calls.Load() < 2 {
+		runtime.Gosched()
+	}
+
+	var entered atomic.Int32
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entered.Add(1)
+			if err := c.RefreshNow(ctx); err != nil {
+				t.Error(err)
+			}
+			if v, _ := c.Get(ctx, "version"); v != 3 {
+				t.Error("expected data loaded after the call, got", v)
+			}
+		}()
+	}
+	for entered.Load() < 4 {
+		runtime.Gosched()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	if n := calls.Load(); n != 3 {
+		t.Fatal("expected the calls during a refresh to share one follow-up, got", n-1)
+	}
+	if !c.LastRefresh().After(first) {
+		t.Fatal("expected the refresh time to advance")
+	}
+}
+
+func TestCacheMapCloseWaitsForRefresh(t *testing.T) {
+	var calls, running atomic.Int32
+	gate := make(chan struct{})
+	c := cache.NewMap[string, int32](time.Hour, time.Hour, func(ctx context.Context, set func(string, int32)) bool {
+		running.Add(1)
+		defer running.Add(-1)
+		if calls.Add(1) == 2 {
+			<-gate
+		}
+		return true
+	})
+	ctx := context.Background()
+	c.WaitReady(ctx)
+
+	go c.RefreshNow(ctx)
+	for calls.Load() < 2 {
+		runtime.Gosched()
+	}
+	go c.RefreshNow(ctx) // A follow-up, which Close must also wait for
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the refresh in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(gate)
+	<-closed
+	if n := running.Load(); n != 0 {
+		t.Fatal("expected no refresh running after Close, got", n)
+	}
+}
+
+func TestCacheMapSwapOnRefresh(t *testing.T) {
+	var pass atomic.Int32
+	inRefresh, resume := make(chan struct{}), make(chan struct{})
+	c := cache.NewMap[string, int32](time.Hour, time.Hour, func(ctx context.Context, set func(string, int32)) bool {
+		switch pass.Add(1) {
+		case 1:
+			set("a", 1)
+			set("old", 1)
+		default:
+			set("a", 2)
+			inRefresh <- struct{}{}
+			<-resume
+			set("b", 2)
+		}
+		return true
+	}, cache.WithSwapOnRefresh())
+	defer c.Close()
+	ctx := context.Background()
+	c.Get(ctx, "a")
+
+	done := make(chan error)
+	go func() { done <- c.RefreshNow(ctx) }()
+	<-inRefresh
+	if v, _ := c.Get(ctx, "a"); v != 1 {
+		t.Fatal("expected the previous dataset during the refresh, got", v)
+	}
+	close(resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	values, _ := c.GetMany(ctx, "a", "b", "old")
+	if len(values) != 2 || values["a"] != 2 || values["b"] != 2 {
+		t.Fatal("expected the new dataset without the dropped key, got", values)
+	}
+}
+
+func TestCacheMapTombstone(t *testing.T) {
+	c := cache.NewMapWithTombstones[string, int](time.Hour, time.Hour,
+		func(ctx context.Context, set func(string, int), tombstone func(string)) bool {
+			set("present", 1)
+			tombstone("gone")
+			return true
+		})
+
+	ctx := context.Background()
+	if v, status := c.Lookup(ctx, "present"); status != cache.StatusFound || v != 1 {
+		t.Fatal("expected present to be found, got", v, status)
+	}
+	if _, status := c.Lookup(ctx, "gone"); status != cache.StatusAbsent {
+		t.Fatal("expected gone to be absent, got", status)
+	}
+	if _, status := c.Lookup(ctx, "other"); status != cache.StatusUnknown {
+		t.Fatal("expected other to be unknown, got", status)
+	}
+	if _, ok := c.Get(ctx, "gone"); ok {
+		t.Fatal("expected Get to miss on a tombstone")
+	}
+}
+
+func TestCacheMaintenanceInterval(t *testing.T) {
+	c := cache.New[string, int](time.Hour, 20*time.Millisecond, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithMaintenanceInterval(10*time.Millisecond))
+	defer c.Close()
+
+	c.Get(context.Background(), "key")
+	for deadline := time.Now().Add(time.Second); c.Contains("key"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry to expire between short maintenance cycles")
+		}
+	}
+}
+
+func TestCacheGetOrSetRace(t *testing.T) {
+	c := cache.New[int, int](time.Hour, time.Hour, func(ctx context.Context, i int) (int, bool) {
+		return i, true
+	})
+	defer c.Close()
+	c.CostFunc = func(v int) int64 {
+		runtime.Gosched() // Widen the race between the callers
+		return 1
+	}
+
+	const keys, racers = 200, 8
+	var (
+		wg     sync.WaitGroup
+		stored [keys]atomic.Int32
+		start  = make(chan struct{})
+	)
+	for key := range keys {
+		for i := range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if _, loaded := c.GetOrSet(key, i); !loaded {
+					stored[key].Add(1)
+				}
+			}()
+		}
+	}
+	close(start)
+	wg.Wait()
+
+	for key := range keys {
+		if n := stored[key].Load(); n != 1 {
+			t.Fatal("expected a single value stored for key", key, "got", n)
+		}
+	}
+	if cost := c.Cost(); cost != keys {
+		t.Fatal("expected only the stored values to be charged, got", cost)
+	}
+}
+
+func TestCacheGetOrSet(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+
+	var wg sync.WaitGroup
+	results := make([]int, 20)
+	var stored atomic.Int32
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, loaded := c.GetOrSet("key", i)
+			if !loaded {
+				stored.Add(1)
+			}
+			results[i] = v
+		}()
+	}
+	wg.Wait()
+
+	if n := stored.Load(); n != 1 {
+		t.Fatal("expected a single value stored, got", n)
+	}
+	for _, v := range results {
+		if v != results[0] {
+			t.Fatal("expected every caller to see the same value, got", results)
+		}
+	}
+	if v, ok := c.Get(context.Background(), "key"); !ok || v != results[0] {
+		t.Fatal("expected the stored value to be cached, got", v, ok)
+	}
+}
+
+func TestCacheGetAndDelete(t *testing.T) {
+	var calls int
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls++
+		return len(s), true
+	})
+	c.Set("job", 7)
+
+	if v, ok := c.GetAndDelete("job"); !ok || v != 7 {
+		t.Fatal("expected job to be handed out, got", v, ok)
+	}
+	if _, ok := c.GetAndDelete("job"); ok {
+		t.Fatal("expected job to be handed out only once")
+	}
+	if calls != 0 {
+		t.Fatal("expected no refresh on miss, got", calls)
+	}
+}
+
+func TestCacheGetAndDeleteRace(t *testing.T) {
+	c := cache.New[int, int](time.Hour, time.Hour, func(ctx context.Context, i int) (int, bool) {
+		return i, true
+	})
+	defer c.Close()
+
+	const jobs, racers = 200, 8
+	for job := range jobs {
+		c.Set(job, job)
+	}
+	var (
+		wg      sync.WaitGroup
+		handled [jobs]atomic.Int32
+		start   = make(chan struct{})
+	)
+	for job := range jobs {
+		for range racers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if _, ok := c.GetAndDelete(job); ok {
+					handled[job].Add(1)
+				}
+			}()
+		}
+	}
+	close(start)
+	wg.Wait()
+
+	for job := range jobs {
+		if n := handled[job].Load(); n != 1 {
+			t.Fatal("expected job", job, "to be handed out once, got", n)
+		}
+	}
+}
+
+func TestCacheMapRefreshTrigger(t *testing.T) {
+	trigger := make(chan struct{})
+	var generation atomic.Int32
+	c := cache.NewMap[string, int](0, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		set("gen", int(generation.Add(1)))
+		return true
+	}, cache.WithRefreshTrigger(trigger))
+
+	ctx := context.Background()
+	if v, _ := c.Get(ctx, "gen"); v != 1 {
+		t.Fatal("expected first generation, got", v)
+	}
+	trigger <- struct{}{}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if v, _ := c.Get(ctx, "gen"); v == 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("expected second generation, got", v)
+		}
+	}
+}
+
+func TestCacheMapClosedTrigger(t *testing.T) {
+	trigger := make(chan struct{})
+	var loads atomic.Int32
+	c := cache.NewMap[string, int](0, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		set("gen", int(loads.Add(1)))
+		return true
+	}, cache.WithRefreshTrigger(trigger))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "gen")
+	close(trigger)
+	time.Sleep(50 * time.Millisecond)
+	if n := loads.Load(); n != 1 {
+		t.Fatal("expected no refresh after the trigger closed, got", n)
+	}
+	if v, ok := c.Get(ctx, "gen"); !ok || v != 1 {
+		t.Fatal("expected the last values to be kept, got", v, ok)
+	}
+}
+
+func TestCacheRefreshCoalesce(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var calls atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if calls.Add(1) > 1 {
+			entered <- struct{}{}
+			<-release
+		}
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	// Make the entry due for a background refresh while in use
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(90 * time.Minute)
+	c.Get(ctx, "key")
+
+	swept := make(chan cache.SweepStats)
+	go func() {
+		swept <- c.Sweep()
+	}()
+	<-entered
+
+	results := make(chan bool, 2)
+	go func() {
+		v, ok := c.Refresh(ctx, "key")
+		results <- ok && v == 3
+	}()
+	go func() {
+		v, ok := c.GetWithin(ctx, "key", 0)
+		results <- ok && v == 3
+	}()
+	for c.RefreshShared("key") < 2 {
+		runtime.Gosched()
+	}
+	close(release)
+
+	if stats := <-swept; stats.Refreshed != 1 {
+		t.Fatal("expected the sweep to refresh the entry, got", stats.Refreshed)
+	}
+	for range 2 {
+		if !<-results {
+			t.Fatal("expected the on-demand refreshes to share the sweep's result")
+		}
+	}
+	if n := calls.Load() - 1; n != 1 {
+		t.Fatal("expected a single refreshFunc call, got", n)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	refreshed := make(map[string]int)
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		refreshed[s]++
+		return len(s), true
+	})
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Get(ctx, key)
+		time.Sleep(time.Millisecond)
+	}
+	c.Get(ctx, "a") // Most recently used
+
+	if n := c.Evict(2); n != 2 {
+		t.Fatal("expected 2 entries evicted, got", n)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Get(ctx, key)
+	}
+	if refreshed["a"] != 1 || refreshed["d"] != 1 || refreshed["b"] != 2 || refreshed["c"] != 2 {
+		t.Fatal("expected b and c to be evicted, got", refreshed)
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	c := cache.New[int, []byte](40*time.Millisecond, time.Hour, func(ctx context.Context, i int) ([]byte, bool) {
+		return make([]byte, 1000), true
+	})
+	c.MaxBytes = 20_000
+	ctx := context.Background()
+	for i := range 100 {
+		c.Get(ctx, i)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if est := c.EstimatedBytes(); est == 0 || est > c.MaxBytes {
+		t.Fatal("expected estimate within budget, got", est)
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c := cache.New[int, int](40*time.Millisecond, time.Hour, func(ctx context.Context, i int) (int, bool) {
+		return i, true
+	})
+	c.MaxEntries = 10
+	ctx := context.Background()
+	for i := range 50 {
+		c.Get(ctx, i)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if n := c.Len(); n != 10 {
+		t.Fatal("expected the cache trimmed to 10 entries, got", n)
+	}
+	if !c.Contains(49) || c.Contains(0) {
+		t.Fatal("expected the least recently used entries to be evicted")
+	}
+}
+
+func TestCacheOnEvict(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	var mu sync.Mutex
+	evicted := make(map[string]int)
+	c.OnEvict = func(key string, value int) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted[key] += value
+		if key == "boom" {
+			panic("callback failure")
+		}
+	}
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "bb", "boom"} {
+		c.Get(ctx, key)
+	}
+	c.Delete("a")
+	c.Delete("a")
+	c.Clear()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evicted) != 3 || evicted["a"] != 1 || evicted["bb"] != 2 || evicted["boom"] != 4 {
+		t.Fatal("expected each entry reported once, got", evicted)
+	}
+}
+
+func TestCacheOnEvictReplaced(t *testing.T) {
+	var generation atomic.Int32
+	c := cache.New[string, string](time.Hour, time.Hour, func(ctx context.Context, s string) (string, bool) {
+		return fmt.Sprint("refresh-", generation.Add(1)), true
+	})
+	defer c.Close()
+	var mu sync.Mutex
+	var evicted []string
+	c.OnEvict = func(key string, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted = append(evicted, value)
+	}
+	report := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprint(evicted)
+	}
+
+	ctx := context.Background()
+	c.Set("k", "file-1")
+	c.Set("k", "file-2")
+	if got := report(); got != "[file-1]" {
+		t.Fatal("expected the replaced value to be reported, got", got)
+	}
+
+	_, release, _ := c.Borrow(ctx, "k")
+	c.Refresh(ctx, "k")
+	c.Delete("k")
+	if got := report(); got != "[file-1]" {
+		t.Fatal("expected no report while the entry is borrowed, got", got)
+	}
+	release()
+	if got := report(); got != "[file-1 file-2 refresh-1]" {
+		t.Fatal("expected the values to be reported once released, got", got)
+	}
+}
+
+func TestCacheSetWithExpiry(t *testing.T) {
+	c := cache.New[string, int](40*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	c.SetWithExpiry("token", 1, time.Now().Add(20*time.Millisecond))
+	c.Set("plain", 2)
+	time.Sleep(60 * time.Millisecond)
+
+	if c.Contains("token") {
+		t.Fatal("expected the entry to expire at its explicit expiry")
+	}
+	if !c.Contains("plain") {
+		t.Fatal("expected the plain entry to follow KeepTime")
+	}
+}
+
+func TestCacheGetPastExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, string](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (string, bool) {
+		return "new-token", true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	c.SetWithExpiry("token", "old-token", clock.Now().Add(5*time.Minute))
+	if v, ok := c.GetIfPresent("token"); !ok || v != "old-token" {
+		t.Fatal("expected the value before its expiry, got", v, ok)
+	}
+	clock.Advance(9 * time.Minute)
+	if _, ok := c.GetIfPresent("token"); ok {
+		t.Fatal("expected no value past its expiry")
+	}
+	if v, ok := c.Get(context.Background(), "token"); !ok || v != "new-token" {
+		t.Fatal("expected a miss past the expiry without waiting for a sweep, got", v, ok)
+	}
+}
+
+func TestCacheReadsPastExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, 0, func(ctx context.Context, s string) (int, bool) {
+		return 1, true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	for name, read := range map[string]func() (int, bool){
+		"Peek": func() (int, bool) { return c.Peek("token") },
+		"Contains": func() (int, bool) {
+			return 7, c.Contains("token")
+		},
+		"Range": func() (v int, ok bool) {
+			c.Range(func(_ string, value int) bool {
+				v, ok = value, true
+				return true
+			})
+			return
+		},
+		"Keys": func() (int, bool) { return 7, len(c.Keys()) > 0 },
+		"Partition": func() (v int, ok bool) {
+			v, ok = c.Partition(1, func(string) int { return 0 })[0]["token"]
+			return
+		},
+		"GetNoStore":   func() (int, bool) { return c.GetNoStore(ctx, "token") },
+		"GetOrSet":     func() (int, bool) { v, _ := c.GetOrSet("token", 2); return v, v == 7 },
+		"GetAndDelete": func() (int, bool) { return c.GetAndDelete("token") },
+		"GetOrPlaceholder": func() (int, bool) {
+			return c.GetOrPlaceholder("token", 0)
+		},
+		"GetWithUpdate": func() (int, bool) {
+			return c.GetWithUpdate(ctx, "token", func(int) {})
+		},
+	} {
+		c.Clear()
+		c.SetWithExpiry("token", 7, clock.Now().Add(5*time.Minute))
+		clock.Advance(9 * time.Minute)
+		if v, ok := read(); ok && v == 7 {
+			t.Error(name, "served a value past its expiry")
+		}
+	}
+}
+
+func TestCacheInvariantsExplicitExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return 1, true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(time.Minute))
+	defer c.Close()
+
+	c.SetWithExpiry("lease", 7, clock.Now().Add(3*time.Hour))
+	clock.Advance(2 * time.Hour)
+	if err := c.CheckInvariants(); err != nil {
+		t.Fatal("expected an entry within its explicit expiry to be valid, got", err)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	var version atomic.Int32
+	c := cache.New[string, int32](time.Hour, time.Hour, func(ctx context.Context, s string) (int32, bool) {
+		return version.Add(1), true
+	})
+
+	ctx := context.Background()
+	c.Invalidate("missing")
+	if c.Contains("missing") {
+		t.Fatal("expected Invalidate of a missing key to do nothing")
+	}
+
+	c.Get(ctx, "key")
+	c.Invalidate("key")
+	if v, _ := c.Get(ctx, "key"); v != 2 {
+		t.Fatal("expected an invalidated entry to be recomputed, got", v)
+	}
+	if v, _ := c.Get(ctx, "key"); v != 2 {
+		t.Fatal("expected the recomputed value to be cached, got", v)
+	}
+	if v, _ := c.Refresh(ctx, "key"); v != 3 {
+		t.Fatal("expected Refresh to recompute, got", v)
+	}
+	if v, _ := c.Peek("key"); v != 3 {
+		t.Fatal("expected Refresh to replace the cached value, got", v)
+	}
+}
+
+func TestCacheGetMany(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return len(s), s != "missing"
+	})
+
+	start := time.Now()
+	got, err := c.GetMany(context.Background(), []string{"a", "bb", "a", "ccc", "missing", "bb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got["a"] != 1 || got["bb"] != 2 || got["ccc"] != 3 {
+		t.Fatal("unexpected results", got)
+	}
+	if n := calls.Load(); n != 4 {
+		t.Fatal("expected one refresh per unique key, got", n)
+	}
+	if elapsed := time.Since(start); elapsed > 60*time.Millisecond {
+		t.Fatal("expected misses to be resolved concurrently, took", elapsed)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		return 0, false
+	})
+	c.NegativeTTL = 20 * time.Millisecond
+
+	ctx := context.Background()
+	for range 5 {
+		if _, ok := c.Get(ctx, "missing"); ok {
+			t.Fatal("expected a miss")
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatal("expected the absent key to be remembered, got", n, "calls")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	c.Get(ctx, "missing")
+	if n := calls.Load(); n != 2 {
+		t.Fatal("expected the absent key to be retried after NegativeTTL, got", n, "calls")
+	}
+}
+
+func TestCacheEverLoaded(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), s != "failing"
+	})
+	defer c.Close()
+	c.NegativeTTL = time.Hour
+
+	ctx := context.Background()
+	c.Get(ctx, "failing")
+	c.Get(ctx, "loaded")
+	for key, want := range map[string][2]bool{
+		"failing": {false, true},
+		"loaded":  {true, true},
+		"absent":  {false, false},
+	} {
+		if everLoaded, present := c.EverLoaded(key); everLoaded != want[0] || present != want[1] {
+			t.Fatal("unexpected EverLoaded for", key, everLoaded, present)
+		}
+	}
+}
+
+func TestCacheRefreshJitter(t *testing.T) {
+	refresh := func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}
+	a := cache.New[string, int](time.Hour, time.Hour, refresh)
+	b := cache.New[string, int](time.Hour, time.Hour, refresh)
+	if j := a.JitterOf("key"); j != 0 {
+		t.Fatal("expected no jitter by default, got", j)
+	}
+
+	for _, c := range []*cache.Cache[string, int]{a, b} {
+		c.RefreshJitter = time.Minute
+		c.RefreshJitterSeed = 42
+	}
+	distinct := make(map[time.Duration]struct{})
+	for i := range 10 {
+		key := fmt.Sprint("key", i)
+		j := a.JitterOf(key)
+		if j < 0 || j >= time.Minute {
+			t.Fatal("jitter out of range", j)
+		}
+		if j != b.JitterOf(key) {
+			t.Fatal("expected the same jitter for the same seed")
+		}
+		distinct[j] = struct{}{}
+	}
+	if len(distinct) < 2 {
+		t.Fatal("expected keys to be spread out")
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+	} else {
+		f.timers = append(f.timers, fakeTimer{at: f.now.Add(d), ch: ch})
+	}
+	return ch
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, timer := range f.timers {
+		if timer.at.After(f.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.ch <- f.now
+		}
+	}
+	f.timers = pending
+}
+
+// waiting returns how many timers are pending
+func (f *fakeClock) waiting() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func TestCacheClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, 2*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock))
+	defer c.Close()
+
+	c.Get(context.Background(), "key")
+	clock.Advance(2 * time.Hour)
+	for deadline := time.Now().Add(time.Second); c.Contains("key"); {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry to expire on the fake clock")
+		}
+		clock.Advance(15 * time.Minute)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheConcurrentGet(t *testing.T) {
+	c := cache.New[string, int](20*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deadline := time.Now().Add(50 * time.Millisecond); time.Now().Before(deadline); {
+				if v, ok := c.Get(ctx, "key"); !ok || v != 3 {
+					t.Error("unexpected value", v, ok)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheCancelledCompute(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			return 0, false
+		}
+		return len(s), true
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Get(ctx, "key")
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	var served atomic.Int32
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok := c.Get(context.Background(), "key"); ok && v == 3 {
+				served.Add(1)
+			}
+		}()
+	}
+	for c.Waiters("key") < 50 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if n := served.Load(); n != 50 {
+		t.Fatal("expected every waiter to be served after the cancellation, got", n)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatal("expected a single recomputation, got", n)
+	}
+}
+
+func TestCacheAbandonedCompute(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if calls.Add(1) == 1 {
+			<-release // Ignores the cancellation
+			return 0, false
+		}
+		return len(s), true
+	})
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Get(ctx, "key")
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	served := make(chan int)
+	for range 2 {
+		go func() {
+			v, _ := c.Get(context.Background(), "key")
+			served <- v
+		}()
+	}
+	for c.Waiters("key") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	for range 2 {
+		select {
+		case v := <-served:
+			if v != 3 {
+				t.Fatal("expected a waiter to take over the computation, got", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the waiters not to wait for the abandoned computation")
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatal("expected a single recomputation, got", n)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	release := make(chan struct{})
+	var version atomic.Int32
+	c := cache.New[string, int32](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int32, bool) {
+		if version.Load() > 0 {
+			<-release
+		}
+		return version.Add(1), true
+	}, cache.WithClock(clock))
+	c.ServeStale = true
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(2 * time.Hour)
+	for range 10 {
+		if v, ok := c.Get(ctx, "key"); !ok || v != 1 {
+			t.Fatal("expected the stale value right away, got", v, ok)
+		}
+	}
+	close(release)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if v, _ := c.Peek("key"); v == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry to be refreshed in the background")
+		}
+	}
+	if n := version.Load(); n != 2 {
+		t.Fatal("expected a single background refresh, got", n-1)
+	}
+}
+
+func TestCacheMaxStale(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var version atomic.Int32
+	c := cache.New[string, int32](time.Hour, 10*time.Hour, func(ctx context.Context, s string) (int32, bool) {
+		return version.Add(1), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	c.MaxStale = 2 * time.Hour
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+
+	// Fresh values are served as is
+	clock.Advance(30 * time.Minute)
+	if v, _ := c.Get(ctx, "key"); v != 1 || version.Load() != 1 {
+		t.Fatal("expected the fresh value without a refresh, got", v)
+	}
+
+	// Stale values are served while refreshed in the background
+	clock.Advance(time.Hour)
+	if v, _ := c.Get(ctx, "key"); v != 1 {
+		t.Fatal("expected the stale value, got", v)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if v, _ := c.Peek("key"); v == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a background refresh")
+		}
+	}
+
+	// Values past MaxStale are refreshed before being served
+	clock.Advance(150 * time.Minute)
+	if v, _ := c.Get(ctx, "key"); v != 3 {
+		t.Fatal("expected a synchronous refresh, got", v)
+	}
+}
+
+func TestCacheEntryAge(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var failing atomic.Bool
+	c := cache.New[string, int](time.Hour, 10*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), !failing.Load()
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	if _, ok := c.NewestEntry(); ok {
+		t.Fatal("expected no entry in an empty cache")
+	}
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	clock.Advance(30 * time.Minute)
+	c.Get(ctx, "b")
+
+	failing.Store(true)
+	clock.Advance(90 * time.Minute)
+	c.Refresh(ctx, "a")
+	c.Refresh(ctx, "b")
+	if age, ok := c.NewestEntry(); !ok || age != 90*time.Minute {
+		t.Fatal("expected the newest entry to age while refreshes fail, got", age, ok)
+	}
+	if age, ok := c.OldestEntry(); !ok || age != 2*time.Hour {
+		t.Fatal("unexpected oldest entry age", age, ok)
+	}
+}
+
+func TestCacheTopN(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, 10*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "c"} {
+		c.Get(ctx, key)
+		clock.Advance(time.Minute)
+	}
+	c.Get(ctx, "a")
+
+	if keys := c.TopByLastUsed(2); fmt.Sprint(keys) != "[a c]" {
+		t.Fatal("unexpected most recently used keys", keys)
+	}
+	if keys := c.OldestN(5); fmt.Sprint(keys) != "[a b c]" {
+		t.Fatal("unexpected oldest keys", keys)
+	}
+}
+
+func TestCacheTouchOnGet(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, 10*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	c.TouchOnGet = false
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b"} {
+		c.Get(ctx, key)
+		clock.Advance(time.Minute)
+	}
+	if v, ok := c.Get(ctx, "a"); !ok || v != 1 {
+		t.Fatal("expected the cached value, got", v, ok)
+	}
+
+	if keys := c.TopByLastUsed(1); fmt.Sprint(keys) != "[b]" {
+		t.Fatal("expected reads not to count as uses, got", keys)
+	}
+}
+
+func TestCacheTouchOnGetRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	calls := map[string]int{}
+	c := cache.New[string, int](time.Hour, 10*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls[s]++
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	c.TouchOnGet = false
+
+	ctx := context.Background()
+	c.Get(ctx, "used")
+	c.Get(ctx, "idle")
+	clock.Advance(90 * time.Minute)
+	c.Get(ctx, "used")
+	if hits := c.Stats().Hits; hits != 0 {
+		t.Fatal("expected hits not to be counted, got", hits)
+	}
+
+	c.Sweep()
+	if calls["used"] != 2 || calls["idle"] != 1 {
+		t.Fatal("expected only the read entry to be refreshed, got", calls)
+	}
+	clock.Advance(90 * time.Minute)
+	c.Sweep()
+	if calls["used"] != 2 {
+		t.Fatal("expected no refresh without a read since the last, got", calls)
+	}
+}
+
+func TestCacheCopyFunc(t *testing.T) {
+	c := cache.New[string, []byte](time.Hour, time.Hour, func(ctx context.Context, s string) ([]byte, bool) {
+		return []byte(s), true
+	})
+	defer c.Close()
+	c.CopyFunc = bytes.Clone
+
+	ctx := context.Background()
+	for range 2 {
+		v, ok := c.Get(ctx, "key")
+		if !ok || string(v) != "key" {
+			t.Fatal("expected the cached value intact, got", string(v), ok)
+		}
+		v[0] = 'x'
+	}
+	c.Range(func(key string, v []byte) bool {
+		v[0] = 'x'
+		return true
+	})
+	c.Partition(1, func(string) int { return 0 })[0]["key"][0] = 'x'
+	if v, ok := c.Peek("key"); !ok || string(v) != "key" {
+		t.Fatal("expected the cached value intact, got", string(v), ok)
+	}
+}
+
+func TestCacheGetWithAge(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock))
+	defer c.Close()
+
+	ctx := context.Background()
+	if _, age, ok := c.GetWithAge(ctx, "key"); !ok || age != 0 {
+		t.Fatal("expected a fresh value, got", age, ok)
+	}
+	clock.Advance(10 * time.Minute)
+	if v, age, ok := c.GetWithAge(ctx, "key"); !ok || v != 3 || age != 10*time.Minute {
+		t.Fatal("expected a 10 minute old value, got", v, age, ok)
+	}
+}
+
+func TestCacheMaxCost(t *testing.T) {
+	c := cache.New[int, []byte](time.Hour, time.Hour, func(ctx context.Context, i int) ([]byte, bool) {
+		return make([]byte, i), true
+	}, cache.WithMaintenanceInterval(10*time.Millisecond))
+	c.CostFunc = func(b []byte) int64 { return int64(len(b)) }
+	c.MaxCost = 100
+
+	ctx := context.Background()
+	for _, size := range []int{10, 20, 30, 40} {
+		c.Get(ctx, size)
+	}
+	if cost := c.Cost(); cost != 100 {
+		t.Fatal("expected a total cost of 100, got", cost)
+	}
+	c.Delete(20)
+	c.Set(10, make([]byte, 5))
+	if cost := c.Cost(); cost != 75 {
+		t.Fatal("expected the total to follow deletes and sets, got", cost)
+	}
+
+	c.Get(ctx, 50)
+	for deadline := time.Now().Add(time.Second); c.Cost() > 100; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the cache to be trimmed under MaxCost, got", c.Cost())
+		}
+	}
+	if !c.Contains(50) || c.Contains(30) {
+		t.Fatal("expected the least recently used entries to be evicted")
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refresh := func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}
+	c := cache.New[string, int](time.Hour, 2*time.Hour, refresh, cache.WithClock(clock))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "old")
+	clock.Advance(90 * time.Minute)
+	c.Get(ctx, "new")
+
+	var buf bytes.Buffer
+	if err := c.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	var calls atomic.Int32
+	restored := cache.New[string, int](time.Hour, 2*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		return refresh(ctx, s)
+	}, cache.WithClock(clock))
+	defer restored.Close()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Contains("old") {
+		t.Fatal("expected the expired entry to be skipped")
+	}
+	if v, age, ok := restored.GetWithAge(ctx, "new"); !ok || v != 3 || age != time.Hour {
+		t.Fatal("expected the entry restored with its age, got", v, age, ok)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatal("expected restored entries to be hits, got", n, "refreshes")
+	}
+	if source, _ := restored.Source("new"); source != cache.SourceLoad {
+		t.Fatal("expected the restored entry to report a load, got", source)
+	}
+}
+
+func TestCacheSnapshotExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var calls atomic.Int32
+	refresh := func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		return len(s), true
+	}
+	c := cache.New[string, int](time.Hour, 0, refresh, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	c.SetWithExpiry("token", 7, clock.Now().Add(time.Hour))
+	c.SetWithExpiry("lease", 8, clock.Now().Add(3*time.Hour))
+
+	var before, after bytes.Buffer
+	if err := c.Snapshot(&before); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	if err := c.Snapshot(&after); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var restored *cache.Cache[string, int]
+	for _, buf := range []*bytes.Buffer{&before, &after} {
+		restored = cache.New[string, int](time.Hour, 0, refresh, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+		defer restored.Close()
+		if err := restored.Restore(buf); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Len() != 1 {
+			t.Fatal("expected the expired entry to be left out, got", restored.Len())
+		}
+		if v, ok := restored.Get(ctx, "lease"); !ok || v != 8 {
+			t.Fatal("expected the entry still valid to be restored, got", v, ok)
+		}
+	}
+
+	// The explicit expiry is kept rather than keeping the entry forever
+	clock.Advance(2 * time.Hour)
+	if v, _ := restored.Get(ctx, "lease"); v != 5 || calls.Load() != 1 {
+		t.Fatal("expected the restored entry to expire, got", v)
+	}
+}
+
+func TestCacheSource(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "got")
+	c.Set("set", 1)
+	c.Get(ctx, "refreshed")
+	c.Refresh(ctx, "refreshed")
+	c.Get(ctx, "background")
+	c.RefreshEntry(ctx, "background")
+	c.Get(ctx, "invalidated")
+	c.Invalidate("invalidated")
+	c.Get(ctx, "invalidated")
+
+	for key, want := range map[string]cache.Source{
+		"got":         cache.SourceGet,
+		"set":         cache.SourceSet,
+		"refreshed":   cache.SourceRefresh,
+		"background":  cache.SourceBackground,
+		"invalidated": cache.SourceRefresh,
+		"missing":     cache.SourceNone,
+	} {
+		if source, _ := c.Source(key); source != want {
+			t.Errorf("expected %s to come from %v, got %v", key, want, source)
+		}
+	}
+}
+
+func TestCacheSourceRace(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			c.Refresh(ctx, "a")
+		}
+	}()
+	for range 100 {
+		c.Source("a")
+		c.Backend("a")
+	}
+	wg.Wait()
+	if source, _ := c.Source("a"); source != cache.SourceRefresh {
+		t.Fatal("expected the refresh to be recorded, got", source)
+	}
+}
+
+func TestCacheWarm(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.NewE[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, error) {
+		calls.Add(1)
+		if s == "bad" {
+			return 0, errors.New("not found")
+		}
+		return len(s), nil
+	})
+	c.Set("cached", 0)
+
+	err := c.Warm(context.Background(), "a", "bb", "a", "cached", "bad")
+	if err == nil {
+		t.Fatal("expected the failed key to be reported")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatal("expected one refresh per missing key, got", n)
+	}
+	if !c.Contains("a") || !c.Contains("bb") {
+		t.Fatal("expected the warmed keys to be cached")
+	}
+}
+
+func TestCacheOnEvent(t *testing.T) {
+	c := cache.NewE[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, error) {
+		if s == "bad" {
+			return 0, errors.New("not found")
+		}
+		return len(s), nil
+	})
+	var kinds []cache.EventKind
+	c.OnEvent = func(ev cache.Event[string]) {
+		kinds = append(kinds, ev.Kind)
+		if ev.Kind == cache.EventError && ev.Err == nil {
+			t.Error("expected the error event to carry the error")
+		}
+		panic("callback failure")
+	}
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	c.Get(ctx, "a")
+	c.Get(ctx, "bad")
+	c.Delete("a")
+
+	want := []cache.EventKind{cache.EventMiss, cache.EventRefreshStart, cache.EventRefreshEnd, cache.EventHit,
+		cache.EventMiss, cache.EventRefreshStart, cache.EventError, cache.EventEviction}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Fatal("expected events", want, "got", kinds)
+	}
+}
+
+func TestCacheSetStatic(t *testing.T) {
+	c := cache.New[string, int](20*time.Millisecond, 30*time.Millisecond, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+	c.Set("normal", 100)
+	c.SetStatic("pinned", 100)
+
+	ctx := context.Background()
+	for range 10 {
+		c.Get(ctx, "normal")
+		c.Get(ctx, "pinned")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if v, _ := c.Peek("normal"); v != len("normal") {
+		t.Fatal("expected the value set with Set to be refreshed, got", v)
+	}
+	if v, _ := c.Peek("pinned"); v != 100 {
+		t.Fatal("expected the static value to be kept, got", v)
+	}
+}
+
+func TestCacheGetIfPresent(t *testing.T) {
+	release := make(chan struct{})
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if s == "slow" {
+			<-release
+		}
+		return len(s), true
+	})
+	defer c.Close()
+
+	if _, ok := c.GetIfPresent("a"); ok || c.Contains("a") {
+		t.Fatal("expected a miss without computing the value")
+	}
+	go c.Get(context.Background(), "slow")
+	for c.Len() == 0 {
+		runtime.Gosched()
+	}
+	if _, ok := c.GetIfPresent("slow"); ok {
+		t.Fatal("expected a value being computed not to be ready")
+	}
+	close(release)
+
+	c.Set("a", 0)
+	if v, ok := c.GetIfPresent("a"); !ok || v != 0 {
+		t.Fatal("expected the cached zero value, got", v, ok)
+	}
+	if hits := c.Stats().Hits; hits != 1 {
+		t.Fatal("expected the read to count as a hit, got", hits)
+	}
+}
+
+func TestCacheBorrow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, *[]byte](time.Hour, 2*time.Hour, func(ctx context.Context, s string) (*[]byte, bool) {
+		if s == "fail" {
+			return nil, false
+		}
+		buf := make([]byte, 1<<10)
+		return &buf, true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	if _, release, ok := c.Borrow(ctx, "fail"); ok {
+		t.Fatal("expected a failed key not to be borrowed")
+	} else {
+		release()
+	}
+
+	first, release1, ok1 := c.Borrow(ctx, "k")
+	second, release2, ok2 := c.Borrow(ctx, "k")
+	if !ok1 || !ok2 || first != second {
+		t.Fatal("expected both borrows to share the cached value")
+	}
+
+	clock.Advance(3 * time.Hour)
+	c.Sweep()
+	if !c.Contains("k") {
+		t.Fatal("expected a borrowed entry to outlive KeepTime")
+	}
+	release1()
+	release1()
+	c.Sweep()
+	if !c.Contains("k") {
+		t.Fatal("expected the entry to be kept until every borrow is released")
+	}
+	release2()
+	c.Sweep()
+	if c.Contains("k") {
+		t.Fatal("expected the entry to expire once released")
+	}
+}
+
+func TestCacheWithKeyLock(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		return len(s), true
+	})
+	defer c.Close()
+
+	// Holders of the same key never overlap
+	var inside, overlaps atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.WithKeyLock("k", func() {
+				if inside.Add(1) > 1 {
+					overlaps.Add(1)
+				}
+				runtime.Gosched()
+				inside.Add(-1)
+			})
+		}()
+	}
+	wg.Wait()
+	if n := overlaps.Load(); n != 0 {
+		t.Fatal("expected WithKeyLock calls to be serialized, got overlaps", n)
+	}
+
+	// A Get computing the key waits for the holder, other keys do not
+	entered, release := make(chan struct{}), make(chan struct{})
+	go c.WithKeyLock("k", func() {
+		close(entered)
+		<-release
+	})
+	<-entered
+	done := make(chan int)
+	go func() {
+		v, _ := c.Get(context.Background(), "k")
+		done <- v
+	}()
+	c.WithKeyLock("other", func() {})
+	if v, ok := c.Get(context.Background(), "other"); !ok || v != 5 {
+		t.Fatal("expected other keys to be computed, got", v, ok)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatal("expected refreshFunc to wait for the lock holder, got calls", n)
+	}
+	close(release)
+	if v := <-done; v != 1 {
+		t.Fatal("expected the value once the lock is released, got", v)
+	}
+}
+
+func TestCacheGetWithUpdate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var generation atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		entered <- struct{}{}
+		<-release
+		return int(generation.Add(1)), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	updates := make(chan int, 2)
+	onFresh := func(v int) { updates <- v }
+
+	// A miss returns right away and delivers the value once computed
+	if _, ok := c.GetWithUpdate(ctx, "k", onFresh); ok {
+		t.Fatal("expected a miss not to be ready")
+	}
+	<-entered
+	release <- struct{}{}
+	if v := <-updates; v != 1 {
+		t.Fatal("expected the computed value, got", v)
+	}
+
+	// A fresh value is returned without an update
+	if v, ok := c.GetWithUpdate(ctx, "k", onFresh); !ok || v != 1 {
+		t.Fatal("expected the fresh value, got", v, ok)
+	}
+
+	// Stale values are served while a single shared refresh runs
+	clock.Advance(2 * time.Hour)
+	for range 2 {
+		if v, ok := c.GetWithUpdate(ctx, "k", onFresh); !ok || v != 1 {
+			t.Fatal("expected the stale value, got", v, ok)
+		}
+	}
+	<-entered
+	for c.RefreshShared("k") < 1 {
+		runtime.Gosched()
+	}
+	release <- struct{}{}
+	for range 2 {
+		if v := <-updates; v != 2 {
+			t.Fatal("expected the refreshed value, got", v)
+		}
+	}
+	if n := generation.Load(); n != 2 {
+		t.Fatal("expected a single refresh, got calls", n)
+	}
+	if len(updates) != 0 {
+		t.Fatal("expected no update for the fresh read")
+	}
+}
+
+func TestCacheGetOrPlaceholder(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	c := cache.New[string, string](time.Hour, time.Hour, func(ctx context.Context, s string) (string, bool) {
+		calls.Add(1)
+		<-release
+		return s + "!", true
+	})
+	defer c.Close()
+
+	for range 3 {
+		if v, ok := c.GetOrPlaceholder("k", "loading"); ok || v != "loading" {
+			t.Fatal("expected the placeholder while computing, got", v, ok)
+		}
+	}
+	for c.Len() == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	for !c.Contains("k") {
+		runtime.Gosched()
+	}
+	if v, ok := c.GetOrPlaceholder("k", "loading"); !ok || v != "k!" {
+		t.Fatal("expected the computed value, got", v, ok)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatal("expected a single computation, got", n)
+	}
+}
+
+func TestCacheDegradedServesExisting(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var calls atomic.Int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		if s == "slow" {
+			close(entered)
+			<-release
+		}
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	go c.Get(ctx, "slow")
+	<-entered
+	c.SetDegraded(true)
+
+	// Gets joining a computation started before are served its result
+	done := make(chan error)
+	go func() {
+		_, err := c.GetE(ctx, "slow")
+		done <- err
+	}()
+	for c.Waiters("slow") == 0 {
+		runtime.Gosched()
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal("expected the in-flight value, got", err)
+	}
+
+	// Stale entries are served as they are, with no refresh
+	clock.Advance(90 * time.Minute)
+	c.Get(ctx, "key")
+	c.Sweep()
+	if v, ok := c.Get(ctx, "key"); !ok || v != 3 {
+		t.Fatal("expected the stale value, got", v, ok)
+	}
+	if _, ok := c.Refresh(ctx, "key"); ok {
+		t.Fatal("expected on-demand refreshes to fail while degraded")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatal("expected no refreshFunc call while degraded, got", n)
+	}
+
+	// Invalidated and expired entries are misses
+	c.Invalidate("key")
+	if _, err := c.GetE(ctx, "key"); !errors.Is(err, cache.ErrDegraded) {
+		t.Fatal("expected ErrDegraded for an invalidated entry, got", err)
+	}
+	c.SetWithExpiry("token", 7, clock.Now().Add(time.Minute))
+	clock.Advance(2 * time.Minute)
+	if _, err := c.GetE(ctx, "token"); !errors.Is(err, cache.ErrDegraded) {
+		t.Fatal("expected ErrDegraded for an expired entry, got", err)
+	}
+}
+
+func TestCacheBackgroundContext(t *testing.T) {
+	type traceKey struct{}
+	background := context.WithValue(context.Background(), traceKey{}, "trace")
+	var traced atomic.Int32
+	c := cache.New[string, int](20*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if ctx.Value(traceKey{}) == "trace" {
+			traced.Add(1)
+		}
+		return len(s), true
+	}, cache.WithBackgroundContext(background))
+	defer c.Close()
+
+	for range 10 {
+		c.Get(context.Background(), "a")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if traced.Load() == 0 {
+		t.Fatal("expected background refreshes to see the values of the background context")
+	}
+}
+
+func TestCacheRefreshPanic(t *testing.T) {
+	var bad, good, goodAtPanic atomic.Int32
+	c := cache.New[string, int](20*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if s != "bad" {
+			good.Add(1)
+		} else if bad.Add(1) > 1 {
+			panic("boom")
+		}
+		return len(s), true
+	})
+	defer c.Close()
+	c.OnPanic = func(key string, recovered any) {
+		if key == "bad" && recovered == "boom" {
+			goodAtPanic.CompareAndSwap(0, good.Load())
+		}
+	}
+
+	ctx := context.Background()
+	for range 20 {
+		c.Get(ctx, "bad")
+		c.Get(ctx, "good")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if goodAtPanic.Load() == 0 {
+		t.Fatal("expected the panic to be reported")
+	}
+	if good.Load() <= goodAtPanic.Load() {
+		t.Fatal("expected the other keys to keep refreshing after the panic")
+	}
+}
+
+func TestCacheSetKeepTime(t *testing.T) {
+	c := cache.New[string, int](40*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+	c.Get(context.Background(), "a")
+
+	// Tune the cache while the maintenance goroutine is running
+	c.SetKeepTime(30 * time.Millisecond)
+	c.SetRefreshTime(20 * time.Millisecond)
+	if c.KeepTime() != 30*time.Millisecond || c.RefreshTime() != 20*time.Millisecond {
+		t.Fatal("expected the new settings, got", c.KeepTime(), c.RefreshTime())
+	}
+	time.Sleep(80 * time.Millisecond)
+	if c.Contains("a") {
+		t.Fatal("expected the entry to expire after the new KeepTime")
+	}
+}
+
+func TestCacheGetNoStore(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		<-release
+		return len(s), true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok := c.GetNoStore(ctx, "key"); !ok || v != 3 {
+				t.Error("expected the computed value, got", v, ok)
+			}
+		}()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // Let the other calls join
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatal("expected concurrent misses to share a computation, got", n)
+	}
+	if c.Contains("key") {
+		t.Fatal("expected the value not to be stored")
+	}
+	c.GetNoStore(ctx, "key")
+	if n := calls.Load(); n != 2 {
+		t.Fatal("expected a later miss to compute again, got", n)
+	}
+}
+
+func TestCacheZeroWhenNotReady(t *testing.T) {
+	var failing atomic.Bool
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		// Return data along with the refusal to store it
+		return 7, !failing.Load()
+	})
+	defer c.Close()
+	ctx := context.Background()
+
+	failing.Store(true)
+	if v, ok := c.Get(ctx, "a"); ok || v != 0 {
+		t.Fatal("expected the zero value of a failed compute, got", v, ok)
+	}
+	if v, ok := c.GetNoStore(ctx, "b"); ok || v != 0 {
+		t.Fatal("expected the zero value of a failed uncached compute, got", v, ok)
+	}
+
+	c.Set("c", 5)
+	c.Invalidate("c")
+	if v, ok := c.Get(ctx, "c"); ok || v != 0 {
+		t.Fatal("expected the zero value of a failed recompute rather than the stale value, got", v, ok)
+	}
+
+	failing.Store(false)
+	c.Set("zero", 0)
+	if v, ok := c.Get(ctx, "zero"); !ok || v != 0 {
+		t.Fatal("expected a stored zero value to be ready, got", v, ok)
+	}
+}
+
+func TestCacheSweepVisitsDueEntries(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[int, int](time.Hour, 3*time.Hour, func(ctx context.Context, n int) (int, bool) {
+		return -n, true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	for i := range 100 {
+		c.Set(i, i)
+	}
+
+	if stats := c.Sweep(); stats.Scanned != 0 {
+		t.Fatal("expected fresh entries to be left alone, scanned", stats.Scanned)
+	}
+	clock.Advance(61 * time.Minute)
+	c.Get(context.Background(), 1)
+	if stats := c.Sweep(); stats.Scanned != 100 || stats.Refreshed != 1 {
+		t.Fatal("expected every entry due and the used one refreshed, got", stats)
+	}
+	if stats := c.Sweep(); stats.Scanned != 0 {
+		t.Fatal("expected idle entries to wait for their expiry, scanned", stats.Scanned)
+	}
+	clock.Advance(2 * time.Hour)
+	if stats := c.Sweep(); stats.Scanned != 100 || stats.Expired != 99 {
+		t.Fatal("expected the idle entries to expire, got", stats)
+	}
+	if v, ok := c.Peek(1); !ok || v != -1 {
+		t.Fatal("expected the refreshed entry to be kept, got", v, ok)
+	}
+}
+
+func TestCacheScheduleBounded(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+
+	for i := range 10000 {
+		c.Set("key", i)
+	}
+	if n := c.DueLen(); n != 1 {
+		t.Fatal("expected a single queued item per key, got", n)
+	}
+}
+
+func BenchmarkSweep(b *testing.B) {
+	c := cache.New[int, int](time.Hour, 0, func(ctx context.Context, n int) (int, bool) {
+		return n, true
+	}, cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	for i := range 100_000 {
+		c.Set(i, i)
+	}
+
+	// Nothing is due, as in most cycles of a large cache
+	b.Run("scan", func(b *testing.B) {
+		for b.Loop() {
+			c.ScanSweep()
+		}
+	})
+	b.Run("heap", func(b *testing.B) {
+		for b.Loop() {
+			c.Sweep()
+		}
+	})
+}
+
+func TestCacheMaxConcurrentRefresh(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	c := cache.New[int, int](time.Hour, time.Hour, func(ctx context.Context, n int) (int, bool) {
+		now := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); now > p && !peak.CompareAndSwap(p, now); p = peak.Load() {
+		}
+		<-release
+		return n, true
+	}, cache.WithMaxConcurrentRefresh(2))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok := c.Get(context.Background(), i); !ok || v != i {
+				t.Error("unexpected value", v, ok)
+			}
+		}()
+	}
+	for inFlight.Load() < 2 {
+		runtime.Gosched()
+	}
+
+	// With every slot taken, a Get gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := c.Get(ctx, 100); ok {
+		t.Fatal("expected the Get to time out waiting for a slot")
+	}
+
+	close(release)
+	wg.Wait()
+	if p := peak.Load(); p != 2 {
+		t.Fatal("expected at most 2 refreshes in flight, got", p)
+	}
+}
+
+func TestCacheWithKey(t *testing.T) {
+	type point struct{ x, y int }
+	sum := func(ctx context.Context, p point) (int, bool) {
+		return p.x + p.y, true
+	}
+	hashes := map[string]func(point) uint64{
+		"distinct":  func(p point) uint64 { return uint64(p.x)<<32 | uint64(p.y) },
+		"colliding": func(point) uint64 { return 0 },
+	}
+	for name, hash := range hashes {
+		t.Run(name, func(t *testing.T) {
+			c := cache.NewWithKey(time.Hour, time.Hour, hash, sum)
+			defer c.Close()
+
+			ctx := context.Background()
+			for _, p := range []point{{1, 2}, {3, 4}, {1, 2}} {
+				if v, ok := c.Get(ctx, p); !ok || v != p.x+p.y {
+					t.Fatal("unexpected value for", p, v, ok)
+				}
+			}
+			c.Set(point{5, 5}, 100)
+			if v, _ := c.Get(ctx, point{5, 5}); v != 100 {
+				t.Fatal("expected the set value, got", v)
+			}
+			c.Delete(point{1, 2})
+			if v, _ := c.Get(ctx, point{5, 5}); v != 100 {
+				t.Fatal("expected Delete to leave other keys alone, got", v)
+			}
+		})
+	}
+}
+
+func TestCacheWithKeyCollisionPanic(t *testing.T) {
+	c := cache.NewWithKey(time.Hour, time.Hour, func(int) uint64 { return 0 }, func(ctx context.Context, n int) (int, bool) {
+		if n < 0 {
+			panic("negative")
+		}
+		return n, true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, 1)
+	if v, ok := c.Get(ctx, -1); ok {
+		t.Fatal("expected the panicking key to fail, got", v)
+	}
+	if v, ok := c.Get(ctx, 1); !ok || v != 1 {
+		t.Fatal("expected the slot to keep its value, got", v, ok)
+	}
+}
+
+func TestCounterAdd(t *testing.T) {
+	c := cache.NewCounter[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return 100, true
+	})
+	ctx := context.Background()
+	c.Get(ctx, "loaded")
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Add("loaded", 1)
+			c.Add("new", 2)
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := c.Get(ctx, "loaded"); v != 150 {
+		t.Fatal("expected 150, got", v)
+	}
+	if v, _ := c.Get(ctx, "new"); v != 100 {
+		t.Fatal("expected 100, got", v)
+	}
+}
+
+func TestCounterKeepsIncrements(t *testing.T) {
+	var loads atomic.Int32
+	c := cache.NewCounter[string, int](20*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		loads.Add(1)
+		return 0, true
+	})
+	defer c.Close()
+
+	ctx := context.Background()
+	for range 10 {
+		c.Add("hits", 1)
+		c.Get(ctx, "hits")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, _ := c.Get(ctx, "hits"); v != 10 {
+		t.Fatal("expected the background refresh to keep the increments, got", v)
+	}
+	if n := loads.Load(); n != 0 {
+		t.Fatal("expected no refresh of the total, got", n)
+	}
+}
+
+func TestRequestCache(t *testing.T) {
+	var calls int
+	c := cache.NewRequestCache[string, int](func(ctx context.Context, s string) (int, bool) {
+		calls++
+		return len(s), s != "missing"
+	})
+	ctx := context.Background()
+
+	c.Get(ctx, "abc")
+	if v, ok := c.Get(ctx, "abc"); !ok || v != 3 || calls != 1 {
+		t.Fatal("expected memoized value, got", v, ok, calls)
+	}
+	if _, ok := c.Get(ctx, "missing"); ok {
+		t.Fatal("expected missing to fail")
+	}
+	if v, loaded := c.GetOrSet("missing", 7); loaded || v != 7 {
+		t.Fatal("expected fallback to be stored, got", v, loaded)
+	}
+	if v, loaded := c.GetOrSet("abc", 7); !loaded || v != 3 {
+		t.Fatal("expected existing value, got", v, loaded)
+	}
+
+	c.Discard()
+	c.Get(ctx, "abc")
+	if calls != 3 {
+		t.Fatal("expected recompute after Discard, got", calls)
+	}
+}
+
+func TestCacheFallback(t *testing.T) {
+	primary := func(ctx context.Context, s string) (int, bool) {
+		return 1, s == "primary"
+	}
+	secondary := func(ctx context.Context, s string) (int, bool) {
+		return 2, true
+	}
+	c := cache.NewWithFallback[string, int](time.Hour, time.Hour,
+		[]func(context.Context, string) (int, bool){primary, secondary})
+
+	ctx := context.Background()
+	if v, _ := c.Get(ctx, "primary"); v != 1 {
+		t.Fatal("expected primary value, got", v)
+	}
+	if v, _ := c.Get(ctx, "other"); v != 2 {
+		t.Fatal("expected secondary value, got", v)
+	}
+	if backend, _ := c.Backend("other"); backend != 1 {
+		t.Fatal("expected secondary backend, got", backend)
+	}
+}
+
+func TestCacheWithSet(t *testing.T) {
+	var calls int
+	c := cache.NewWithSet[int, int](time.Hour, time.Hour, func(ctx context.Context, key int, set func(int, int)) (int, bool) {
+		calls++
+		for sibling := key - key%10; sibling < key-key%10+10; sibling++ {
+			set(sibling, sibling*2)
+		}
+		return key * 2, true
+	})
+
+	ctx := context.Background()
+	for key := range 10 {
+		if v, ok := c.Get(ctx, key); !ok || v != key*2 {
+			t.Fatal("expected", key*2, "got", v, ok)
+		}
+	}
+	if calls != 1 {
+		t.Fatal("expected one batch fetch, got", calls)
+	}
+}
+
+func TestCacheConditional(t *testing.T) {
+	var tokens []string
+	c := cache.NewConditional[string, int](time.Hour, time.Hour, func(ctx context.Context, s string, prevToken string) (int, string, bool) {
+		tokens = append(tokens, prevToken)
+		if prevToken == "v1" {
+			return 0, "v1", false // Not modified
+		}
+		return 42, "v1", true
+	})
+	var evicted []int
+	c.OnEvict = func(key string, value int) {
+		evicted = append(evicted, value)
+	}
+	var events []cache.EventKind
+	c.OnEvent = func(ev cache.Event[string]) {
+		events = append(events, ev.Kind)
+	}
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	events = nil
+	if v, ok := c.RefreshEntry(ctx, "key"); !ok || v != 42 {
+		t.Fatal("expected unchanged value to be kept, got", v, ok)
+	}
+	if v, _ := c.Get(ctx, "key"); v != 42 {
+		t.Fatal("expected cached value 42, got", v)
+	}
+	if len(tokens) != 2 || tokens[0] != "" || tokens[1] != "v1" {
+		t.Fatal("expected tokens to be passed back, got", tokens)
+	}
+	if len(evicted) != 0 {
+		t.Fatal("expected the value still cached not to be reported evicted, got", evicted)
+	}
+	if slices.Contains(events, cache.EventError) {
+		t.Fatal("expected an unchanged answer not to be reported as an error, got", events)
+	}
+}
+
+func TestCacheInvariants(t *testing.T) {
+	c := cache.New[int, int](40*time.Millisecond, 80*time.Millisecond, func(ctx context.Context, i int) (int, bool) {
+		return i, i%3 != 0
+	})
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				c.Get(ctx, (g*i)%50)
+				if i%10 == 0 {
+					c.Set(i, i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := c.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheAdaptiveConcurrency(t *testing.T) {
+	var inflight, peak atomic.Int32
+	c := cache.New[int, int](time.Hour, time.Hour, func(ctx context.Context, i int) (int, bool) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+		return i, true
+	}, cache.WithAdaptiveConcurrency(time.Millisecond, 8))
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Get(ctx, i)
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > 8 {
+		t.Fatal("expected at most 8 concurrent refreshes, got", p)
+	}
+	if _, limit := c.RefreshConcurrency(); limit >= 8 {
+		t.Fatal("expected the limit to back off, got", limit)
+	}
+}
+
+func TestCacheComputeOnSeparateGoroutine(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		<-release
+		return len(s), ctx.Err() == nil
+	})
+	c.ComputeOnSeparateGoroutine = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, ok := c.Get(ctx, "key"); ok {
+		t.Fatal("expected the cancelled caller to give up")
+	}
+	close(release)
+
+	if v, ok := c.Get(context.Background(), "key"); !ok || v != 3 {
+		t.Fatal("expected the detached compute to be cached, got", v, ok)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatal("expected a single refreshFunc call, got", n)
+	}
+}
+
+func TestCacheWorkerPool(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	c := cache.New[int, int](time.Hour, time.Hour, func(ctx context.Context, n int) (int, bool) {
+		now := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); now > p && !peak.CompareAndSwap(p, now); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+		return n, true
+	}, cache.WithWorkerPool(2))
+	defer c.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for n := range 8 { // Cold Gets
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Get(ctx, n)
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p != 2 {
+		t.Fatal("expected at most 2 cold loads in flight, got", p)
+	}
+
+	peak.Store(0)
+	for n := range 8 { // Background refreshes alongside cold Gets
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.RefreshEntry(ctx, n)
+		}()
+		go func() {
+			defer wg.Done()
+			c.Get(ctx, n+8)
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p != 2 {
+		t.Fatal("expected at most 2 refreshes in flight, got", p)
+	}
+}
+
+func TestCacheClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithWorkerPool(4))
+	m := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		set("one", 1)
+		return true
+	})
+
+	ctx := context.Background()
+	c.Get(ctx, "one")
+	m.Get(ctx, "one")
+	c.Close()
+	m.Close()
+
+	if _, ok := c.Get(ctx, "one"); ok {
+		t.Fatal("expected Get on a closed Cache to miss")
+	}
+	if _, ok := m.Get(ctx, "one"); ok {
+		t.Fatal("expected Get on a closed CacheMap to miss")
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected goroutines to exit, got", runtime.NumGoroutine(), "want", before)
+		}
+	}
+}
+
+func TestCacheCollected(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	func() {
+		c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+			return len(s), true
+		}, cache.WithWorkerPool(4))
+		m := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+			set("one", 1)
+			return true
+		})
+
+		ctx := context.Background()
+		c.Get(ctx, "one")
+		m.Get(ctx, "one")
+	}()
+
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected goroutines of dropped caches to exit, got", runtime.NumGoroutine(), "want", before)
+		}
+		runtime.GC()
+	}
+}
+
+func TestCacheDeleteDuringRefresh(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		return len(s), true
+	})
+
+	ctx := context.Background()
+	results := make(chan int, 2)
+	for range 2 {
+		go func() {
+			v, _ := c.Get(ctx, "slow")
+			results <- v
+		}()
+	}
+	for c.Waiters("slow") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Delete("slow")
+	close(release)
+	for range 2 {
+		select {
+		case v := <-results:
+			if v != 4 {
+				t.Fatal("expected in-flight value, got", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Get blocked after Delete")
+		}
+	}
+
+	c.Get(ctx, "slow")
+	if n := calls.Load(); n != 2 {
+		t.Fatal("expected the deleted key to be recomputed, got", n)
+	}
+}
+
+func TestCacheRange(t *testing.T) {
+	release := make(chan struct{})
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if s == "slow" {
+			<-release
+		}
+		return len(s), true
+	})
+	defer close(release)
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	c.Get(ctx, "bb")
+	go c.Get(ctx, "slow")
+	for c.Len() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	got := make(map[string]int)
+	c.Range(func(key string, value int) bool {
+		got[key] = value
+		return true
+	})
+	if len(got) != 2 || got["a"] != 1 || got["bb"] != 2 {
+		t.Fatal("expected only the populated entries, got", got)
+	}
+	if keys := c.Keys(); len(keys) != 2 {
+		t.Fatal("expected 2 keys, got", keys)
+	}
+	if n := c.LenReady(); n != 2 {
+		t.Fatal("expected 2 ready entries, got", n)
+	}
+
+	visited := 0
+	c.Range(func(string, int) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Fatal("expected Range to stop early, visited", visited)
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	release := make(chan struct{})
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if s == "slow" {
+			<-release
+		}
+		return len(s), true
+	})
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	result := make(chan int)
+	go func() {
+		v, _ := c.Get(ctx, "slow")
+		result <- v
+	}()
+	for c.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Clear()
+	if n := c.Len(); n != 0 {
+		t.Fatal("expected an empty cache, got", n)
+	}
+	close(release)
+	select {
+	case v := <-result:
+		if v != 4 {
+			t.Fatal("expected in-flight value, got", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get blocked after Clear")
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+	var calls atomic.Int32
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		calls.Add(1)
+		return len(s), true
+	})
+
+	if _, ok := c.Peek("abc"); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatal("expected Peek not to compute, got", n, "calls")
+	}
+
+	c.Get(context.Background(), "abc")
+	if v, ok := c.Peek("abc"); !ok || v != 3 {
+		t.Fatal("expected the cached value, got", v, ok)
+	}
+}
+
+func TestCacheGetE(t *testing.T) {
+	errBackend := errors.New("backend down")
+	release := make(chan struct{})
+	c := cache.NewE[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, error) {
+		<-release
+		return 0, errBackend
+	})
+
+	ctx := context.Background()
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			_, err := c.GetE(ctx, "key")
+			errs <- err
+		}()
+	}
+	for c.Waiters("key") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for range 3 {
+		if err := <-errs; !errors.Is(err, errBackend) {
+			t.Fatal("expected the refresh error for every waiter, got", err)
+		}
+	}
+
+	c.SetDegraded(true)
+	if _, err := c.GetE(ctx, "other"); !errors.Is(err, cache.ErrDegraded) {
+		t.Fatal("expected ErrDegraded, got", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	c.SizeOf = func(v int) int { return v }
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	c.Get(ctx, "a")
+	c.Get(ctx, "a")
+	c.Get(ctx, "bb")
+	c.RefreshEntry(ctx, "bb")
+	c.Delete("bb")
+	c.SetDegraded(true)
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Refreshes != 1 || stats.Size != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if !stats.Degraded || stats.BytesFromCache != 2 || stats.BytesFromBackend != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.ChurnRatio != c.ChurnRatio() {
+		t.Fatalf("unexpected churn ratio %+v", stats)
+	}
+}
+
+func TestCacheMapDiff(t *testing.T) {
+	c := cache.NewMapWithTombstones[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int), tombstone func(string)) bool {
+		set("same", 1)
+		set("changed", 2)
+		set("added", 3)
+		tombstone("gone")
+		return true
+	})
+	defer c.Close()
+	c.WaitReady(context.Background())
+
+	prev := map[string]int{"same": 1, "changed": 1, "removed": 4}
+	added, removed, changed := c.Diff(prev, func(a, b int) bool { return a == b })
+	if fmt.Sprint(added, removed, changed) != "[added] [removed] [changed]" {
+		t.Fatal("unexpected diff", added, removed, changed)
+	}
+}
+
+func TestCacheMapInitialDelay(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var calls atomic.Int32
+	c := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		calls.Add(1)
+		set("key", 1)
+		return true
+	}, cache.WithClock(clock), cache.WithInitialDelay(time.Minute, 0))
+	defer c.Close()
+
+	for clock.waiting() == 0 {
+		runtime.Gosched()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if c.WaitReady(ctx) || calls.Load() != 0 {
+		t.Fatal("expected no refresh before the initial delay")
+	}
+
+	clock.Advance(time.Minute)
+	if v, ok := c.Get(context.Background(), "key"); !ok || v != 1 || calls.Load() != 1 {
+		t.Fatal("expected the first refresh after the initial delay, got", v, ok)
+	}
+}
+
+func TestCacheSoftLimit(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	var sizes []int
+	c.SoftLimit = 2
+	c.OnSoftLimit = func(size int) {
+		sizes = append(sizes, size)
+	}
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	c.Set("d", 4)
+	if fmt.Sprint(sizes) != "[3]" {
+		t.Fatal("expected a single warning past the limit, got", sizes)
+	}
+
+	// The warning is rearmed by a sweep once back under the limit
+	c.Delete("c")
+	c.Set("e", 5)
+	if fmt.Sprint(sizes) != "[3]" {
+		t.Fatal("expected no warning until a sweep rearms it, got", sizes)
+	}
+	c.Delete("d")
+	c.Delete("e")
+	c.Sweep()
+	c.Set("f", 6)
+	if fmt.Sprint(sizes) != "[3 3]" {
+		t.Fatal("expected a new warning once rearmed, got", sizes)
+	}
+}
+
+func TestCacheAdaptiveRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[s]++
+		return calls[s], true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	c.AdaptiveRefresh = true
+	c.MinRefreshTime = 10 * time.Minute
+
+	ctx := context.Background()
+	c.Get(ctx, "cold")
+	for range 6 {
+		c.Get(ctx, "hot")
+	}
+
+	// The hot entry is due after 10 minutes, the cold one after 20
+	clock.Advance(15 * time.Minute)
+	c.Get(ctx, "hot")
+	c.Get(ctx, "cold")
+	if stats := c.Sweep(); stats.Refreshed != 1 {
+		t.Fatal("expected a single refresh, got", stats.Refreshed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["hot"] != 2 || calls["cold"] != 1 {
+		t.Fatal("expected only the hot entry to be refreshed, got", calls)
+	}
+}
+
+func TestCacheAdaptiveRefreshRace(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+	c.AdaptiveRefresh = true
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			c.Refresh(ctx, "a")
+		}
+	}()
+	for range 100 {
+		c.Get(ctx, "a")
+	}
+	wg.Wait()
+	if err := c.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheSweepBacklog(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	clock.Advance(2 * time.Hour)
+	c.Set("c", 3)
+
+	stats := c.Sweep()
+	if stats.Backlog != 2 || stats.Expired != 2 {
+		t.Fatalf("expected the two expired entries as backlog, got %+v", stats)
+	}
+	if last := c.LastSweepStats(); last != stats {
+		t.Fatalf("expected the last sweep stats, got %+v", last)
+	}
+	if stats := c.Sweep(); stats.Backlog != 0 {
+		t.Fatalf("expected the backlog cleared, got %+v", stats)
+	}
+}
+
+func TestCacheOnRefreshTimeout(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var slow atomic.Bool
+	c := cache.New[string, int](20*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if slow.Load() {
+			<-ctx.Done()
+			return 0, false
+		}
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	var warnings []int
+	c.RefreshTimeoutThreshold = 2
+	c.OnRefreshTimeout = func(key string, consecutive int) {
+		warnings = append(warnings, consecutive)
+	}
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(30 * time.Millisecond)
+	c.Get(ctx, "key")
+
+	// Each timed out refresh is retried on the next sweep
+	slow.Store(true)
+	for range 3 {
+		c.Sweep()
+	}
+	if fmt.Sprint(warnings) != "[2]" {
+		t.Fatal("expected a single warning at the threshold, got", warnings)
+	}
+}
+
+func TestCacheBackgroundRefreshesCompleted(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var slow atomic.Bool
+	c := cache.New[string, int](20*time.Millisecond, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if slow.Load() {
+			<-ctx.Done()
+			return 0, false
+		}
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(30 * time.Millisecond)
+	c.Get(ctx, "key")
+
+	slow.Store(true)
+	c.Sweep()
+	if c.BackgroundRefreshTimeouts() != 1 || c.BackgroundRefreshesCompleted() != 0 {
+		t.Fatal("expected a timed out refresh, got", c.BackgroundRefreshTimeouts(), c.BackgroundRefreshesCompleted())
+	}
+
+	slow.Store(false)
+	if stats := c.Sweep(); stats.Refreshed != 1 {
+		t.Fatal("expected the refresh to succeed, got", stats.Refreshed)
+	}
+	if c.BackgroundRefreshTimeouts() != 1 || c.BackgroundRefreshesCompleted() != 1 {
+		t.Fatal("expected a completed refresh, got", c.BackgroundRefreshTimeouts(), c.BackgroundRefreshesCompleted())
+	}
+}
+
+func TestCachePartition(t *testing.T) {
+	release := make(chan struct{})
+	c := cache.New[int, int](time.Hour, time.Hour, func(ctx context.Context, k int) (int, bool) {
+		<-release
+		return k, true
+	})
+	defer c.Close()
+	defer close(release)
+
+	for k := range 6 {
+		c.Set(k, k*10)
+	}
+	go c.Get(context.Background(), 100)
+	for c.Len() < 7 {
+		runtime.Gosched()
+	}
+
+	groups := c.Partition(3, func(k int) int { return -k })
+	if len(groups) != 3 {
+		t.Fatal("expected 3 groups, got", len(groups))
+	}
+	for i, group := range groups {
+		if len(group) != 2 {
+			t.Fatal("expected two entries per group, got", group)
+		}
+		for k, v := range group {
+			if (-k%3+3)%3 != i || v != k*10 {
+				t.Fatal("unexpected entry in group", i, k, v)
+			}
+		}
+	}
+	if c.Partition(0, func(k int) int { return k }) != nil {
+		t.Fatal("expected no groups")
+	}
+}
+
+func TestCacheRefreshAheadWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var calls atomic.Int32
+	c := cache.New[string, int](24*time.Hour, 2*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return int(calls.Add(1)), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	c.RefreshAheadWindow = 30 * time.Minute
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(time.Hour)
+	if v, _ := c.Get(ctx, "key"); v != 1 || calls.Load() != 1 {
+		t.Fatal("expected no renewal outside the window, got", v)
+	}
+
+	// Within the window the current value is served and renewed
+	clock.Advance(40 * time.Minute)
+	if v, _ := c.Get(ctx, "key"); v != 1 {
+		t.Fatal("expected the current value, got", v)
+	}
+	for v, _ := c.Peek("key"); v != 2; v, _ = c.Peek("key") {
+		runtime.Gosched()
+	}
+	clock.Advance(time.Hour)
+	if !c.Contains("key") {
+		t.Fatal("expected the renewed entry to outlive the old expiry")
+	}
+}
+
+func TestCacheSweepProgress(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var block atomic.Bool
+	entered, release := make(chan struct{}), make(chan struct{})
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		if block.Load() {
+			entered <- struct{}{}
+			<-release
+		}
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	c.Get(ctx, "b")
+	clock.Advance(90 * time.Minute)
+	c.Get(ctx, "a")
+	c.Get(ctx, "b")
+
+	block.Store(true)
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		c.Sweep()
+	}()
+	for i := 1; i <= 2; i++ {
+		<-entered
+		if scanned, total := c.SweepProgress(); scanned != i || total != 2 {
+			t.Fatal("unexpected progress", scanned, total)
+		}
+		release <- struct{}{}
+	}
+	<-swept
+	if scanned, total := c.SweepProgress(); scanned != 0 || total != 0 {
+		t.Fatal("expected no progress between sweeps, got", scanned, total)
+	}
+}
+
+func TestCacheMapOnDuplicateKey(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.NewMap[string, int](time.Hour, time.Hour, func(ctx context.Context, set func(string, int)) bool {
+		set("a", 1)
+		set("b", 2)
+		set("a", 3)
+		return true
+	}, cache.WithClock(clock), cache.WithInitialDelay(time.Minute, 0))
+	defer c.Close()
+	var duplicates []string
+	c.OnDuplicateKey = func(key string) {
+		duplicates = append(duplicates, key)
+	}
+
+	for clock.waiting() == 0 {
+		runtime.Gosched()
+	}
+	clock.Advance(time.Minute)
+	if v, _ := c.Get(context.Background(), "a"); v != 3 {
+		t.Fatal("expected the later value, got", v)
+	}
+	if fmt.Sprint(duplicates) != "[a]" || c.DuplicateKeys() != 1 {
+		t.Fatal("expected the duplicate key to be reported, got", duplicates)
+	}
+}
+
+func TestCacheOnStaleServe(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+	var ages []time.Duration
+	c.OnStaleServe = func(key string, age time.Duration) {
+		ages = append(ages, age)
+	}
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(30 * time.Minute)
+	c.Get(ctx, "key")
+	clock.Advance(time.Hour)
+	c.Get(ctx, "key")
+	if fmt.Sprint(ages) != "[1h30m0s]" {
+		t.Fatal("expected only the stale read to be reported, got", ages)
+	}
+}
+
+func TestCacheGetWithin(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var generation atomic.Int32
+	var fail atomic.Bool
+	c := cache.New[string, int](time.Hour, 24*time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return int(generation.Add(1)), !fail.Load()
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "key")
+	clock.Advance(10 * time.Minute)
+	if v, ok := c.GetWithin(ctx, "key", 15*time.Minute); !ok || v != 1 {
+		t.Fatal("expected the cached value, got", v, ok)
+	}
+	if v, ok := c.GetWithin(ctx, "key", 5*time.Minute); !ok || v != 2 {
+		t.Fatal("expected a refreshed value, got", v, ok)
+	}
+
+	fail.Store(true)
+	clock.Advance(10 * time.Minute)
+	if _, ok := c.GetWithin(ctx, "key", 5*time.Minute); ok {
+		t.Fatal("expected no value when the refresh fails")
+	}
+	if v, ok := c.Get(ctx, "key"); !ok || v != 2 {
+		t.Fatal("expected the old value to be kept, got", v, ok)
+	}
+}
+
+func TestCacheBytesServed(t *testing.T) {
+	c := cache.New[string, string](time.Hour, time.Hour, func(ctx context.Context, s string) (string, bool) {
+		return s + s, true
+	})
+	defer c.Close()
+	c.SizeOf = func(v string) int { return len(v) }
+
+	ctx := context.Background()
+	c.Get(ctx, "abc")
+	c.Get(ctx, "abc")
+	c.Get(ctx, "abc")
+	c.Get(ctx, "z")
+	if fromCache, fromBackend := c.BytesServed(); fromCache != 12 || fromBackend != 8 {
+		t.Fatal("unexpected bytes served", fromCache, fromBackend)
+	}
+}
+
+func TestCacheMapToCache(t *testing.T) {
+	m := cache.NewMapWithTombstones[string, int](time.Hour, 2*time.Hour, func(ctx context.Context, set func(string, int), tombstone func(string)) bool {
+		set("a", 1)
+		set("b", 2)
+		tombstone("gone")
+		return true
+	})
+	defer m.Close()
+	m.WaitReady(context.Background())
+
+	c := m.ToCache(func(ctx context.Context, s string) (int, bool) {
+		return 100, true
+	})
+	defer c.Close()
+	if c.RefreshTime() != time.Hour || c.KeepTime() != 2*time.Hour {
+		t.Fatal("expected the timings of the map, got", c.RefreshTime(), c.KeepTime())
+	}
+	if a, _ := c.Peek("a"); a != 1 || c.Len() != 2 {
+		t.Fatal("expected the entries of the map, got", a, c.Len())
+	}
+	if v, _ := c.Get(context.Background(), "gone"); v != 100 {
+		t.Fatal("expected tombstoned keys to be computed, got", v)
+	}
+}
+
+func TestCacheChurnRatio(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	}, cache.WithClock(clock), cache.WithMaintenanceInterval(1000*time.Hour))
+	defer c.Close()
+
+	ctx := context.Background()
+	c.Get(ctx, "once")
+	for range 3 {
+		c.Get(ctx, "reused")
+	}
+	if r := c.ChurnRatio(); r != 0 {
+		t.Fatal("expected no churn before any eviction, got", r)
+	}
+	clock.Advance(2 * time.Hour)
+	c.Sweep()
+	if r := c.ChurnRatio(); r != 0.5 {
+		t.Fatal("expected half of the evicted entries to have churned, got", r)
+	}
+}
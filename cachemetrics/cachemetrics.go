@@ -0,0 +1,87 @@
+// Package cachemetrics exports the statistics of a cache to Prometheus.  It
+// is a module of its own so that only its users depend on the Prometheus
+// client.
+package cachemetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cache "github.com/pschou/go-cachefn"
+)
+
+type (
+	// Source is what a Collector reads on every scrape, which any
+	// cache.Cache provides
+	Source interface {
+		Stats() cache.Stats
+	}
+
+	// Collector is a prometheus.Collector reporting the hits, misses,
+	// refreshes, evictions and size of a cache as of each scrape, along with a
+	// histogram of the refresh latencies fed to Observe
+	Collector struct {
+		source    Source
+		hits      *prometheus.Desc
+		misses    *prometheus.Desc
+		refreshes *prometheus.Desc
+		evictions *prometheus.Desc
+		entries   *prometheus.Desc
+		latency   prometheus.Histogram
+	}
+)
+
+// New creates a Collector for source, labeling its metrics with the cache
+// name so that several caches can be registered side by side
+func New(name string, source Source) *Collector {
+	labels := prometheus.Labels{"cache": name}
+	desc := func(metric, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("cache", "", metric), help, nil, labels)
+	}
+	return &Collector{
+		source:    source,
+		hits:      desc("hits_total", "Gets served from an existing entry."),
+		misses:    desc("misses_total", "Gets that had to compute the value."),
+		refreshes: desc("refreshes_total", "Existing entries regenerated."),
+		evictions: desc("evictions_total", "Entries expired or evicted for size."),
+		entries:   desc("entries", "Entries currently in the cache."),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "cache",
+			Name:        "refresh_duration_seconds",
+			Help:        "Time taken by refreshFunc calls.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}),
+	}
+}
+
+// Observe records the latency of the refreshes among the events of the cache,
+// and is meant to be called from its OnEvent:
+//
+//	c.OnEvent = func(ev cache.Event[string]) { collector.Observe(ev.Kind, ev.Duration) }
+func (m *Collector) Observe(kind cache.EventKind, d time.Duration) {
+	if kind == cache.EventRefreshEnd || kind == cache.EventError {
+		m.latency.Observe(d.Seconds())
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.hits
+	ch <- m.misses
+	ch <- m.refreshes
+	ch <- m.evictions
+	ch <- m.entries
+	m.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := m.source.Stats()
+	ch <- prometheus.MustNewConstMetric(m.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(m.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(m.refreshes, prometheus.CounterValue, float64(stats.Refreshes))
+	ch <- prometheus.MustNewConstMetric(m.evictions, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(m.entries, prometheus.GaugeValue, float64(stats.Size))
+	m.latency.Collect(ch)
+}
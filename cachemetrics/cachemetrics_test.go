@@ -0,0 +1,59 @@
+package cachemetrics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cache "github.com/pschou/go-cachefn"
+	"github.com/pschou/go-cachefn/cachemetrics"
+)
+
+func TestCollector(t *testing.T) {
+	c := cache.New[string, int](time.Hour, time.Hour, func(ctx context.Context, s string) (int, bool) {
+		return len(s), true
+	})
+	defer c.Close()
+	collector := cachemetrics.New("test", c)
+	c.OnEvent = func(ev cache.Event[string]) { collector.Observe(ev.Kind, ev.Duration) }
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	ctx := context.Background()
+	c.Get(ctx, "a")
+	c.Get(ctx, "a")
+	c.Get(ctx, "bb")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.GetCounter() != nil:
+				got[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				got[family.GetName()] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				got[family.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	want := map[string]float64{
+		"cache_hits_total":               1,
+		"cache_misses_total":             2,
+		"cache_refreshes_total":          0,
+		"cache_evictions_total":          0,
+		"cache_entries":                  2,
+		"cache_refresh_duration_seconds": 2,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, got[name])
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package cache
+
+import "time"
+
+type (
+	// Clock is the source of time of a Cache or CacheMap, which can be
+	// replaced with WithClock so tests can advance time instantly
+	Clock interface {
+		Now() time.Time
+		After(d time.Duration) <-chan time.Time
+	}
+
+	// realClock tells the wall clock time
+	realClock struct{}
+)
+
+// Now returns the current time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for d to elapse and then sends the current time
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/exp/constraints"
+)
+
+type (
+	// numeric interface defines types that can be summed by a Counter
+	numeric interface {
+		constraints.Integer | constraints.Float | constraints.Complex
+	}
+
+	// Counter is a Cache of numeric values that can be incremented atomically,
+	// for aggregating in memory between flushes to a backend
+	Counter[K hashable, V numeric] struct {
+		*Cache[K, V]
+	}
+)
+
+// NewCounter creates a new counter cache with specified refresh time and
+// refresh function, see New.  refreshFunc only loads the initial value of a
+// key: totals are never refreshed in the background, which would drop the
+// increments not flushed yet, but still expire after KeepTime.
+func NewCounter[K hashable, V numeric](RefreshTime, KeepTime time.Duration,
+	refreshFunc func(context.Context, K) (V, bool), opts ...Option) *Counter[K, V] {
+	opts = append(opts[:len(opts):len(opts)], withoutRefresh())
+	return &Counter[K, V]{Cache: New(RefreshTime, KeepTime, refreshFunc, opts...)}
+}
+
+// Add atomically adds delta to the value stored for key and returns the new
+// total.  A key that is not cached starts from zero without calling
+// refreshFunc, while a key still being computed is waited on first.
+func (c *Counter[K, V]) Add(key K, delta V) V {
+	for {
+		value, ok := c.cacheMap.Get(key)
+		if !ok || !value.loaded.Load() {
+			if _, loaded := c.GetOrSet(key, delta); !loaded {
+				return delta
+			}
+			continue
+		}
+
+		// Retry when a Set or another Add replaced the total in the meantime
+		for {
+			old := value.data.Load()
+			total := *old + delta
+			if value.data.CompareAndSwap(old, &total) {
+				c.charge(value, total)
+				value.lastUsed.Store(c.clock.Now())
+				return total
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package cache
+
+import "time"
+
+type (
+	// EventKind tells what an Event describes
+	EventKind int
+
+	// Event describes something that happened to a key of a Cache, see
+	// OnEvent
+	Event[K hashable] struct {
+		Kind     EventKind
+		Key      K
+		Duration time.Duration // How long the refresh took, for EventRefreshEnd and EventError
+		Err      error         // Why the refresh failed, for EventError
+	}
+)
+
+const (
+	EventHit          EventKind = iota // A Get was served from an existing entry
+	EventMiss                          // A Get had to compute the value
+	EventRefreshStart                  // refreshFunc is about to be called for the key
+	EventRefreshEnd                    // refreshFunc returned a value for the key
+	EventEviction                      // An entry holding a value left the cache
+	EventError                         // refreshFunc failed, in place of EventRefreshEnd
+)
+
+// String returns the name of the kind, such as "hit"
+func (k EventKind) String() string {
+	switch k {
+	case EventHit:
+		return "hit"
+	case EventMiss:
+		return "miss"
+	case EventRefreshStart:
+		return "refresh start"
+	case EventRefreshEnd:
+		return "refresh end"
+	case EventEviction:
+		return "eviction"
+	case EventError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// emit calls OnEvent, shielding the caller from a panic in the callback
+func (c *Cache[K, V]) emit(ev Event[K]) {
+	if c.OnEvent == nil {
+		return
+	}
+	defer func() {
+		recover()
+	}()
+	c.OnEvent(ev)
+}
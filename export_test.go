@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// RefreshEntry exposes the per-entry refresh used by background and
+// on-demand refreshes so tests can race them directly
+func (c *Cache[K, V]) RefreshEntry(ctx context.Context, key K) (V, bool) {
+	value, ok := c.cacheMap.Get(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return c.refreshEntry(ctx, key, value, SourceBackground)
+}
+
+// RefreshShared returns how many callers joined the refresh of key in flight,
+// or -1 when none is
+func (c *Cache[K, V]) RefreshShared(key K) int {
+	if value, ok := c.cacheMap.Get(key); ok {
+		if call := value.refreshing.Load(); call != nil {
+			return int(call.shared.Load())
+		}
+	}
+	return -1
+}
+
+// CheckInvariants exposes checkInvariants to tests
+func (c *Cache[K, V]) CheckInvariants() error {
+	return c.checkInvariants()
+}
+
+// JitterOf exposes the refresh delay derived for key
+func (c *Cache[K, V]) JitterOf(key K) time.Duration {
+	return c.refreshJitter(key)
+}
+
+// Sweep runs a maintenance cycle right away and returns its stats
+func (c *Cache[K, V]) Sweep() SweepStats {
+	c.sweep()
+	return c.LastSweepStats()
+}
+
+// DueLen returns the number of keys queued for maintenance
+func (c *Cache[K, V]) DueLen() int {
+	c.dueMu.Lock()
+	defer c.dueMu.Unlock()
+	return c.dueQueue.Len()
+}
+
+// ScanSweep examines every entry the way maintenance cycles did before they
+// were scheduled, as a baseline for benchmarks, and returns how many were due
+func (c *Cache[K, V]) ScanSweep() (due int) {
+	now := c.clock.Now()
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if !value.static && (c.expiredAt(value, now) ||
+			now.Sub(value.created.Load()) >= c.refreshTime(value)+c.refreshJitter(key)) {
+			due++
+		}
+		return true
+	})
+	return
+}
@@ -0,0 +1,42 @@
+package cache
+
+import "fmt"
+
+// checkInvariants verifies the internal consistency of the cache, returning
+// the first violation found.  It is meant for tests, where concurrent use
+// should never leave the cache in a state rejected here.
+func (c *Cache[K, V]) checkInvariants() (err error) {
+	now := c.clock.Now()
+	sweepInterval := c.maintenanceInterval()
+
+	var count int
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		count++
+		switch {
+		case value.ready == nil && !value.loaded.Load():
+			err = fmt.Errorf("key %v: entry without a ready channel was never loaded", key)
+		case value.created.Load().IsZero():
+			err = fmt.Errorf("key %v: entry has no creation time", key)
+		case value.loaded.Load() && !value.computing() && value.lastUsed.Load().IsZero():
+			err = fmt.Errorf("key %v: loaded entry was never used", key)
+		case value.lastUsed.Load().After(now) || value.created.Load().After(now):
+			err = fmt.Errorf("key %v: entry timestamps are in the future", key)
+		case value.waiters.Load() < 0 || value.borrows.Load() < 0:
+			err = fmt.Errorf("key %v: negative waiter or borrow count", key)
+		case value.accesses.Load() < value.accessesAtRefresh.Load():
+			err = fmt.Errorf("key %v: access count went backwards", key)
+		case sweepInterval > 0 && value.borrows.Load() == 0 && !value.static &&
+			!c.expiry(value).IsZero() && now.Sub(c.expiry(value)) > sweepInterval:
+			err = fmt.Errorf("key %v: entry outlived its expiry by more than a sweep interval", key)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+
+	if size := int(c.cacheMap.Len()); size != count {
+		return fmt.Errorf("map reports %d entries but holds %d", size, count)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// KeyedCache is a Cache for any comparable key, such as a small struct,
+	// which the hashable constraint of Cache rules out.  A hash function maps
+	// each key to a slot of an underlying Cache keyed by the hash.  When keys
+	// collide, their slot holds the value of only one of them at a time: the
+	// one last computed or set.  A Get for another key of the slot computes
+	// its value on every call without storing it, as GetNoStore does, so a
+	// good hash only costs a comparison of keys per Get.
+	KeyedCache[K comparable, V any] struct {
+		cache *Cache[uint64, keyedSlot[K, V]]
+		hash  func(K) uint64
+	}
+
+	// keyedSlot is the value of a KeyedCache slot, along with the key it
+	// belongs to
+	keyedSlot[K comparable, V any] struct {
+		key  K
+		data V
+	}
+
+	// keyedContextKey carries the key of a KeyedCache Get to refreshFunc
+	keyedContextKey struct{}
+)
+
+// NewWithKey creates a cache like New for keys of any comparable type, using
+// hash to map them to the slots of the cache, see KeyedCache for how
+// collisions are handled
+func NewWithKey[K comparable, V any](RefreshTime, KeepTime time.Duration, hash func(K) uint64,
+	refreshFunc func(context.Context, K) (V, bool), opts ...Option) *KeyedCache[K, V] {
+	k := &KeyedCache[K, V]{hash: hash}
+	k.cache = NewE(RefreshTime, KeepTime, func(ctx context.Context, h uint64) (slot keyedSlot[K, V], err error) {
+		key, ok := ctx.Value(keyedContextKey{}).(K)
+		if !ok { // Background refresh of the key holding the slot
+			if slot, ok = k.cache.Peek(h); !ok {
+				return slot, ErrNotStored
+			}
+			key = slot.key
+		}
+		data, ok := refreshFunc(ctx, key)
+		if !ok {
+			return keyedSlot[K, V]{}, ErrNotStored
+		}
+		return keyedSlot[K, V]{key: key, data: data}, nil
+	}, opts...)
+	return k
+}
+
+// Get retrieves a value from the cache by key, computing it on a miss
+func (k *KeyedCache[K, V]) Get(ctx context.Context, key K) (data V, ready bool) {
+	h := k.hash(key)
+	ctx = context.WithValue(ctx, keyedContextKey{}, key)
+	slot, ok := k.cache.Get(ctx, h)
+	switch {
+	case !ok:
+		return
+	case slot.key == key:
+		return slot.data, true
+	}
+
+	// The slot is held by a colliding key, so compute without storing under
+	// the same limits as any refresh.  Joining the computation of yet another
+	// colliding key of the slot yields its value, so try again after it.
+	for {
+		if slot, ok = k.cache.computeNoStore(ctx, h); !ok {
+			return
+		}
+		if slot.key == key {
+			return slot.data, true
+		}
+	}
+}
+
+// Set manually adds a value to the cache, taking the slot of any colliding key
+func (k *KeyedCache[K, V]) Set(key K, value V) {
+	k.cache.Set(k.hash(key), keyedSlot[K, V]{key: key, data: value})
+}
+
+// Delete removes the entry for key, leaving a colliding key holding the slot
+// in place
+func (k *KeyedCache[K, V]) Delete(key K) {
+	h := k.hash(key)
+	if slot, ok := k.cache.Peek(h); ok && slot.key == key {
+		k.cache.Delete(h)
+	}
+}
+
+// Len returns the number of slots in use
+func (k *KeyedCache[K, V]) Len() int {
+	return k.cache.Len()
+}
+
+// Stats returns the statistics of the underlying cache
+func (k *KeyedCache[K, V]) Stats() Stats {
+	return k.cache.Stats()
+}
+
+// Close stops the background maintenance and clears the cache
+func (k *KeyedCache[K, V]) Close() error {
+	return k.cache.Close()
+}
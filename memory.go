@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"cmp"
+	"reflect"
+)
+
+// enforceMaxBytes estimates the memory held by the cache from a sample of
+// entries, measured with SizeOf when set, and evicts least recently used
+// entries while the estimate is above MaxBytes
+func (c *Cache[K, V]) enforceMaxBytes() {
+	var sampled, total int64
+	seen := make(map[uintptr]struct{})
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if !value.loaded.Load() || value.computing() {
+			return true
+		}
+		data := value.get()
+		if c.SizeOf != nil {
+			total += int64(c.SizeOf(data))
+		} else {
+			total += deepSize(reflect.ValueOf(&key).Elem(), seen) + deepSize(reflect.ValueOf(&data).Elem(), seen)
+		}
+		sampled++
+		return sampled < int64(cmp.Or(c.SampleSize, 32))
+	})
+	if sampled == 0 {
+		c.estimatedBytes.Store(0)
+		return
+	}
+
+	average := max(total/sampled, 1)
+	estimate := average * int64(c.cacheMap.Len())
+	if estimate > c.MaxBytes {
+		c.Evict(int(c.MaxBytes / average))
+		estimate = average * int64(c.cacheMap.Len())
+	}
+	c.estimatedBytes.Store(estimate)
+}
+
+// enforceMaxCost evicts least recently used entries while the total cost of
+// the cache is above MaxCost
+func (c *Cache[K, V]) enforceMaxCost() {
+	excess := c.totalCost.Load() - c.MaxCost
+	if excess <= 0 {
+		return
+	}
+
+	var toDelete []K
+	for _, candidate := range c.evictCandidates() {
+		if excess <= 0 {
+			break
+		}
+		toDelete = append(toDelete, candidate.key)
+		c.countEviction(candidate.accesses)
+		excess -= candidate.cost
+	}
+	c.remove(toDelete...)
+	for _, key := range toDelete {
+		c.invalidate(key)
+	}
+}
+
+// Cost returns the total cost of the cached values as measured by CostFunc
+func (c *Cache[K, V]) Cost() int64 {
+	return c.totalCost.Load()
+}
+
+// setData stores data in an entry, keeping the total cost up to date
+func (c *Cache[K, V]) setData(value *element[V], data V) {
+	value.set(data)
+	c.charge(value, data)
+}
+
+// charge updates the cost of an entry to that of data, keeping the total cost
+// up to date
+func (c *Cache[K, V]) charge(value *element[V], data V) {
+	if c.CostFunc == nil {
+		return
+	}
+	cost := max(c.CostFunc(data), 0)
+	for {
+		old := value.cost.Load()
+		if old < 0 { // No longer in the cache
+			return
+		}
+		if value.cost.CompareAndSwap(old, cost) {
+			c.totalCost.Add(cost - old)
+			return
+		}
+	}
+}
+
+// detach takes the cost of an entry leaving the cache out of the total, and
+// reports whether this call took the entry out, as racing removals of the
+// same entry may all find it in the map
+func (c *Cache[K, V]) detach(value *element[V]) (claimed bool) {
+	old := value.cost.Swap(-1)
+	if old > 0 {
+		c.totalCost.Add(-old)
+	}
+	return old >= 0
+}
+
+// EstimatedBytes returns the memory held by the cache entries as estimated by
+// the latest maintenance cycle with MaxBytes set
+func (c *Cache[K, V]) EstimatedBytes() int64 {
+	return c.estimatedBytes.Load()
+}
+
+// deepSize approximates the memory held by v, including everything reachable
+// through pointers, strings, slices, maps and interfaces.  Memory reachable
+// more than once is only counted the first time it is seen.
+func deepSize(v reflect.Value, seen map[uintptr]struct{}) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+	return int64(v.Type().Size()) + indirectSize(v, seen)
+}
+
+// indirectSize returns the memory reachable from v, not counting v itself
+func indirectSize(v reflect.Value, seen map[uintptr]struct{}) (size int64) {
+	visited := func(p uintptr) bool {
+		if _, ok := seen[p]; ok {
+			return true
+		}
+		seen[p] = struct{}{}
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() && !visited(v.Pointer()) {
+			size = deepSize(v.Elem(), seen)
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			size = deepSize(v.Elem(), seen)
+		}
+	case reflect.String:
+		size = int64(v.Len())
+	case reflect.Slice:
+		if !v.IsNil() && !visited(v.Pointer()) {
+			size = int64(v.Cap()) * int64(v.Type().Elem().Size())
+			for i := range v.Len() {
+				size += indirectSize(v.Index(i), seen)
+			}
+		}
+	case reflect.Array:
+		for i := range v.Len() {
+			size += indirectSize(v.Index(i), seen)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			size += indirectSize(v.Field(i), seen)
+		}
+	case reflect.Map:
+		if !v.IsNil() && !visited(v.Pointer()) {
+			for iter := v.MapRange(); iter.Next(); {
+				size += deepSize(iter.Key(), seen) + deepSize(iter.Value(), seen)
+			}
+		}
+	}
+	return
+}
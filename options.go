@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+type (
+	// Option configures a Cache or CacheMap at construction time
+	Option func(*options)
+
+	// options holds the construction time settings
+	options struct {
+		initialDelay  time.Duration   // Wait before the first CacheMap refresh
+		initialJitter time.Duration   // Upper bound of random time added to initialDelay
+		workers       int             // Size of the refresh worker pool, 0 to refresh inline
+		trigger       <-chan struct{} // Signals an immediate CacheMap refresh
+		swapOnRefresh bool            // Fill a fresh map on each CacheMap refresh
+
+		targetLatency  time.Duration // Refresh latency the adaptive limit aims for
+		maxConcurrency int           // Upper bound of the adaptive limit
+
+		maxConcurrentRefresh int // Bound on concurrent refreshFunc calls, 0 for none
+
+		clock Clock // Source of time, the wall clock by default
+
+		maintenanceInterval time.Duration // Initial MaintenanceInterval of a Cache
+
+		background context.Context // Parent of the contexts of background refreshes
+
+		noRefresh bool // Never refresh values in the background, see NewCounter
+	}
+)
+
+// WithInitialDelay postpones the first bulk refresh of a CacheMap by delay
+// plus a random duration of up to jitter, spreading out the backend load when
+// many instances start at the same time
+func WithInitialDelay(delay, jitter time.Duration) Option {
+	return func(o *options) {
+		o.initialDelay, o.initialJitter = delay, jitter
+	}
+}
+
+// WithWorkerPool runs every refreshFunc call of a Cache, on-demand and
+// background alike, on a pool of size workers.  Callers wait for a free
+// worker, which bounds the number of concurrent calls to the backend.
+func WithWorkerPool(size int) Option {
+	return func(o *options) {
+		o.workers = size
+	}
+}
+
+// WithRefreshTrigger makes a CacheMap run a bulk refresh every time a value is
+// received on trigger, such as an upstream change notification.  The periodic
+// refresh still runs unless the CacheMap is created with a zero RefreshTime,
+// in which case closing trigger leaves the map with its last values.
+func WithRefreshTrigger(trigger <-chan struct{}) Option {
+	return func(o *options) {
+		o.trigger = trigger
+	}
+}
+
+// WithSwapOnRefresh makes each bulk refresh of a CacheMap fill a fresh map
+// that replaces the current one once refreshFunc succeeds, so lookups see
+// either the previous or the new dataset in full, and keys no longer reported
+// disappear right away instead of after KeepTime.  A failed refresh leaves the
+// current map in place.  Changes made with SetMany or Delete while a refresh
+// runs are lost when its map is swapped in.
+func WithSwapOnRefresh() Option {
+	return func(o *options) {
+		o.swapOnRefresh = true
+	}
+}
+
+// WithAdaptiveConcurrency bounds the concurrent refreshFunc calls of a Cache
+// with a limit that adapts to backend latency.  The limit starts at
+// maxConcurrency, halves whenever a call takes longer than targetLatency, and
+// grows back while calls stay within it.  Refreshes over the limit wait for
+// room until their context is done, and are then given up.
+func WithAdaptiveConcurrency(targetLatency time.Duration, maxConcurrency int) Option {
+	return func(o *options) {
+		o.targetLatency, o.maxConcurrency = targetLatency, maxConcurrency
+	}
+}
+
+// WithMaxConcurrentRefresh bounds the refreshFunc calls of a Cache running at
+// once, on-demand and background alike, to n, such as to stay within a
+// database connection pool.  Calls over the bound wait for a slot until their
+// context is done, in which case the Get returns without a value.
+func WithMaxConcurrentRefresh(n int) Option {
+	return func(o *options) {
+		o.maxConcurrentRefresh = n
+	}
+}
+
+// WithClock makes a Cache or CacheMap tell time with clock instead of the
+// wall clock, for entry ages as well as maintenance scheduling, so tests can
+// advance time instantly
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithMaintenanceInterval sets the MaintenanceInterval of a Cache before its
+// maintenance starts, which setting the field after New cannot guarantee
+func WithMaintenanceInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.maintenanceInterval = interval
+	}
+}
+
+// WithBackgroundContext makes the background refreshes of a Cache or CacheMap,
+// along with any other refreshFunc call not made on behalf of a caller,
+// derive their context from ctx, so its values, such as trace IDs or
+// credentials, and its deadline reach refreshFunc.  ctx must outlive the
+// cache: once it is done the cache stops as if closed.
+func WithBackgroundContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.background = ctx
+	}
+}
+
+// withoutRefresh keeps a Cache from refreshing values in the background
+func withoutRefresh() Option {
+	return func(o *options) {
+		o.noRefresh = true
+	}
+}
+
+// newOptions applies opts over the defaults
+func newOptions(opts []Option) (o options) {
+	o.clock = realClock{}
+	o.background = context.Background()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return
+}
+
+// startDelay returns how long to wait before the first refresh
+func (o *options) startDelay() time.Duration {
+	if o.initialJitter > 0 {
+		return o.initialDelay + rand.N(o.initialJitter)
+	}
+	return o.initialDelay
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+type (
+	// RequestCache is a lightweight memoization cache meant to live for a
+	// single request.  It has no TTL and no background goroutine; values stay
+	// until Discard is called or the RequestCache is dropped.
+	RequestCache[K comparable, V any] struct {
+		mu          sync.Mutex
+		entries     map[K]*requestEntry[V]
+		refreshFunc func(context.Context, K) (val V, store bool) // Function to generate new values
+	}
+
+	// requestEntry represents a single RequestCache entry
+	requestEntry[V any] struct {
+		data  V             // The cached data
+		ok    bool          // Whether data was stored
+		ready chan struct{} // Closed once data is set
+	}
+)
+
+// NewRequestCache creates a new request scoped cache using refreshFunc to
+// generate missing values
+func NewRequestCache[K comparable, V any](refreshFunc func(context.Context, K) (V, bool)) *RequestCache[K, V] {
+	return &RequestCache[K, V]{
+		entries:     make(map[K]*requestEntry[V]),
+		refreshFunc: refreshFunc,
+	}
+}
+
+// Get retrieves a value by key, computing it on a miss.  Concurrent Gets for
+// the same key share one computation, and failed computations are retried by
+// the next Get.
+func (c *RequestCache[K, V]) Get(ctx context.Context, key K) (data V, ready bool) {
+	c.mu.Lock()
+	entry, loaded := c.entries[key]
+	if !loaded {
+		entry = &requestEntry[V]{ready: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	if loaded {
+		select {
+		case <-ctx.Done():
+			return
+		case <-entry.ready:
+		}
+		return entry.data, entry.ok
+	}
+
+	defer close(entry.ready)
+	entry.data, entry.ok = c.refreshFunc(ctx, key)
+	if !entry.ok {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	return entry.data, entry.ok
+}
+
+// GetOrSet returns the value stored for key, or stores and returns value if
+// the key is absent.  loaded reports whether an existing value was returned.
+func (c *RequestCache[K, V]) GetOrSet(key K, value V) (actual V, loaded bool) {
+	for {
+		c.mu.Lock()
+		entry, loaded := c.entries[key]
+		if !loaded {
+			entry = &requestEntry[V]{data: value, ok: true, ready: make(chan struct{})}
+			close(entry.ready)
+			c.entries[key] = entry
+		}
+		c.mu.Unlock()
+
+		if !loaded {
+			return value, false
+		}
+
+		// Wait out a computation in flight, retrying if it fails
+		if <-entry.ready; entry.ok {
+			return entry.data, true
+		}
+	}
+}
+
+// Discard drops every entry of the cache
+func (c *RequestCache[K, V]) Discard() {
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
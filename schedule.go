@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+type (
+	// dueItem is a key scheduled for maintenance at a deadline
+	dueItem[K any] struct {
+		key   K
+		at    int64 // Unix time in nanoseconds
+		index int   // Position in the queue, kept up to date by Swap
+	}
+
+	// dueQueue is a min-heap of keys by deadline, so a maintenance cycle only
+	// visits the entries that are due.  Each key has at most one item, which
+	// only ever moves earlier: an item found due before the deadline of the
+	// entry for its key is queued again at that deadline, and one whose key
+	// left the cache is dropped.
+	dueQueue[K comparable] struct {
+		items []*dueItem[K]
+		index map[K]*dueItem[K]
+	}
+
+	// dueEntry is an entry claimed by a maintenance cycle
+	dueEntry[K any, V any] struct {
+		key   K
+		value *element[V]
+	}
+)
+
+func (q *dueQueue[K]) Len() int           { return len(q.items) }
+func (q *dueQueue[K]) Less(i, j int) bool { return q.items[i].at < q.items[j].at }
+func (q *dueQueue[K]) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index, q.items[j].index = i, j
+}
+func (q *dueQueue[K]) Push(x any) {
+	item := x.(*dueItem[K])
+	item.index = len(q.items)
+	q.items = append(q.items, item)
+}
+func (q *dueQueue[K]) Pop() any {
+	old := q.items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	q.items = old[:len(old)-1]
+	return item
+}
+
+// queue makes key due by at, moving its item earlier if it has one.  The
+// caller holds dueMu.
+func (q *dueQueue[K]) queue(key K, at int64) {
+	if item, ok := q.index[key]; ok {
+		if at < item.at {
+			item.at = at
+			heap.Fix(q, item.index)
+		}
+		return
+	}
+	if q.index == nil {
+		q.index = make(map[K]*dueItem[K])
+	}
+	item := &dueItem[K]{key: key, at: at}
+	q.index[key] = item
+	heap.Push(q, item)
+}
+
+// schedule queues the entry for key for the maintenance cycle following at,
+// replacing its previous deadline.  A zero at leaves it unscheduled until a
+// Get finds it past its refresh time, see scheduleUse.
+func (c *Cache[K, V]) schedule(key K, value *element[V], at time.Time) {
+	if at.IsZero() || value.static {
+		value.due.Store(time.Time{})
+		return
+	}
+	value.due.Store(at)
+	c.dueMu.Lock()
+	defer c.dueMu.Unlock()
+	c.dueQueue.queue(key, at.UnixNano())
+}
+
+// scheduleUse queues an entry used past its refresh time for the next
+// maintenance cycle, unless it is already due
+func (c *Cache[K, V]) scheduleUse(key K, value *element[V]) {
+	now := c.clock.Now()
+	if due := value.due.Load(); (!due.IsZero() && !due.After(now)) || value.static || c.noRefresh {
+		return
+	}
+	age := now.Sub(value.created.Load())
+	if refreshTime := c.refreshTime(value); age < refreshTime || age < refreshTime+c.refreshJitter(key) {
+		return
+	}
+	c.schedule(key, value, now)
+}
+
+// deadline returns when an entry next needs maintenance: once it is past its
+// refresh time or its expiry, whichever comes first
+func (c *Cache[K, V]) deadline(key K, value *element[V]) time.Time {
+	if c.noRefresh {
+		return c.expiry(value)
+	}
+	at := value.created.Load().Add(c.refreshTime(value) + c.refreshJitter(key))
+	if expiry := c.expiry(value); !expiry.IsZero() && expiry.Before(at) {
+		return expiry
+	}
+	return at
+}
+
+// popDue removes the keys due by now from the queue and claims their entries,
+// queuing again the keys whose entry is due later
+func (c *Cache[K, V]) popDue(now time.Time) (due []dueEntry[K, V]) {
+	c.dueMu.Lock()
+	var items []*dueItem[K]
+	for c.dueQueue.Len() > 0 && c.dueQueue.items[0].at <= now.UnixNano() {
+		item := heap.Pop(&c.dueQueue).(*dueItem[K])
+		delete(c.dueQueue.index, item.key)
+		items = append(items, item)
+	}
+	c.dueMu.Unlock()
+
+	for _, item := range items {
+		value, ok := c.cacheMap.Get(item.key)
+		if !ok {
+			continue
+		}
+		// Claiming clears the deadline, so an entry is visited once per deadline
+		for {
+			at := value.due.nanos.Load()
+			if at == 0 {
+				break
+			}
+			if at > now.UnixNano() {
+				c.dueMu.Lock()
+				c.dueQueue.queue(item.key, at)
+				c.dueMu.Unlock()
+				break
+			}
+			if value.due.nanos.CompareAndSwap(at, 0) {
+				due = append(due, dueEntry[K, V]{key: item.key, value: value})
+				break
+			}
+		}
+	}
+	return
+}
+
+// rescheduleAll queues every entry for the next maintenance cycle, after a
+// setting change moved their deadlines
+func (c *Cache[K, V]) rescheduleAll(now time.Time) {
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		c.schedule(key, value, now)
+		return true
+	})
+}
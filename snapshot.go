@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+)
+
+// snapshotEntry is the encoded form of a cache entry
+type snapshotEntry[K hashable, V any] struct {
+	Key      K
+	Value    V
+	Created  time.Time
+	LastUsed time.Time
+	Expires  time.Time // Explicit expiry set with SetWithExpiry, if any
+}
+
+// Snapshot writes every entry holding a value to w with encoding/gob, along
+// with when it was created, last used and set to expire, for a later Restore
+// such as after a restart.  Entries past their explicit expiry are left out.
+// Values stored in interfaces need their concrete types registered with
+// gob.Register by the caller.
+func (c *Cache[K, V]) Snapshot(w io.Writer) (err error) {
+	enc := gob.NewEncoder(w)
+	c.cacheMap.ForEach(func(key K, value *element[V]) bool {
+		if value.computing() || !value.loaded.Load() || c.pastExpiry(value) {
+			return true
+		}
+		err = enc.Encode(snapshotEntry[K, V]{
+			Key:      key,
+			Value:    c.copyOut(value.get()),
+			Created:  value.created.Load(),
+			LastUsed: value.lastUsed.Load(),
+			Expires:  value.expires.Load(),
+		})
+		return err == nil
+	})
+	return
+}
+
+// Restore reads entries written by Snapshot from r into the cache, keeping
+// their age and explicit expiry.  Entries already past their expiry, or
+// KeepTime without one, are skipped, and restored entries replace those
+// already cached for the same keys.
+func (c *Cache[K, V]) Restore(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	now := c.clock.Now()
+	for {
+		var entry snapshotEntry[K, V]
+		if err := dec.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Expires.IsZero() {
+			if now.After(entry.Expires) {
+				continue
+			}
+		} else if keepTime := c.KeepTime(); keepTime > 0 && now.Sub(entry.Created) > keepTime {
+			continue
+		}
+
+		elm := &element[V]{}
+		elm.source.Store(uint32(SourceLoad))
+		c.setData(elm, entry.Value)
+		elm.loaded.Store(true)
+		elm.created.Store(entry.Created)
+		elm.lastUsed.Store(entry.LastUsed)
+		elm.expires.Store(entry.Expires)
+		c.replace(entry.Key, elm)
+		c.schedule(entry.Key, elm, c.deadline(entry.Key, elm))
+		c.invalidate(entry.Key)
+		c.checkSoftLimit()
+	}
+}